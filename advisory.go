@@ -0,0 +1,397 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-db"
+)
+
+// An Advisory records a security issue (a CVE, a USN, etc.) that
+// affects one or more versions of one or more releases / stemcells.
+type Advisory struct {
+	ID          string           `json:"id"`
+	Severity    string           `json:"severity"`
+	Description string           `json:"description"`
+	URL         string           `json:"url,omitempty"`
+	Affects     []AdvisoryTarget `json:"affects"`
+}
+
+// An AdvisoryTarget is an artifact affected by an advisory.  Versions
+// is a list of version ranges, any one of which has to match; an empty
+// list means that every version is affected.  See versionRange().
+type AdvisoryTarget struct {
+	Kind     string   `json:"kind"`
+	Name     string   `json:"name"`
+	Versions []string `json:"versions"`
+}
+
+// An AdvisoryNotice is what gets attached to version records that are
+// affected by an advisory.
+type AdvisoryNotice struct {
+	ID          string `json:"id"`
+	Severity    string `json:"severity"`
+	Description string `json:"description"`
+	URL         string `json:"url,omitempty"`
+}
+
+var severities = []string{"low", "medium", "high", "critical"}
+
+// versionRange parses a version range, which is a list of constraints
+// (separated by spaces or commas) that must all hold.  Constraints are
+// a version, optionally prefixed by one of `>=`, `>`, `<=`, `<` or `=`.
+// A version ending in `.x` (or `.*`) matches anything with that prefix,
+// i.e. `3312.x` is `>=3312 <3313`, and `*` on its own matches anything.
+func versionRange(s string) (func(uint64) bool, error) {
+	type constraint struct {
+		op string
+		n  uint64
+	}
+	var l []constraint
+
+	for _, tok := range strings.FieldsFunc(s, func(c rune) bool { return c == ' ' || c == ',' }) {
+		op := ""
+		for _, o := range []string{">=", "<=", ">", "<", "="} {
+			if strings.HasPrefix(tok, o) {
+				op, tok = o, tok[len(o):]
+				break
+			}
+		}
+
+		wildcard := tok == "*" || tok == "x" || strings.HasSuffix(tok, ".x") || strings.HasSuffix(tok, ".*")
+		if wildcard && op != "" {
+			return nil, fmt.Errorf("invalid version range '%s': wildcards cannot be used with '%s'", s, op)
+		}
+		if tok == "*" || tok == "x" {
+			continue
+		}
+		if wildcard {
+			prefix := strings.Split(tok[:len(tok)-2], ".")
+			lo, err := vnum(strings.Join(prefix, "."))
+			if err != nil {
+				return nil, fmt.Errorf("invalid version range '%s'", s)
+			}
+			last, err := strconv.ParseUint(prefix[len(prefix)-1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version range '%s'", s)
+			}
+			prefix[len(prefix)-1] = fmt.Sprintf("%d", last+1)
+			hi, err := vnum(strings.Join(prefix, "."))
+			if err != nil {
+				return nil, fmt.Errorf("invalid version range '%s'", s)
+			}
+			l = append(l, constraint{">=", lo}, constraint{"<", hi})
+			continue
+		}
+
+		n, err := vnum(tok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version range '%s'", s)
+		}
+		if op == "" {
+			op = "="
+		}
+		l = append(l, constraint{op, n})
+	}
+
+	return func(v uint64) bool {
+		for _, c := range l {
+			switch {
+			case c.op == ">=" && !(v >= c.n),
+				c.op == ">" && !(v > c.n),
+				c.op == "<=" && !(v <= c.n),
+				c.op == "<" && !(v < c.n),
+				c.op == "=" && !(v == c.n):
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// affects checks if version is covered by any of the version ranges.
+func affects(ranges []string, version string) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	n, err := vnum(version)
+	if err != nil {
+		return false
+	}
+	for _, s := range ranges {
+		if in, err := versionRange(s); err == nil && in(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a Advisory) validate() error {
+	if a.ID == "" {
+		return fmt.Errorf("advisory has no id")
+	}
+	ok := false
+	for _, s := range severities {
+		ok = ok || a.Severity == s
+	}
+	if !ok {
+		return fmt.Errorf("invalid severity '%s' (must be one of %s)", a.Severity, strings.Join(severities, ", "))
+	}
+	if len(a.Affects) == 0 {
+		return fmt.Errorf("advisory %s does not affect anything", a.ID)
+	}
+	for _, t := range a.Affects {
+		if t.Kind != "release" && t.Kind != "stemcell" {
+			return fmt.Errorf("invalid kind '%s' (must be 'release' or 'stemcell')", t.Kind)
+		}
+		if t.Name == "" {
+			return fmt.Errorf("advisory %s affects a %s with no name", a.ID, t.Kind)
+		}
+		for _, s := range t.Versions {
+			if _, err := versionRange(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// warnAdvisories adds a Warning header to the response for a pinned
+// version lookup, for each advisory that affects that version.
+func warnAdvisories(w http.ResponseWriter, kind, name, version string, l []AdvisoryNotice) {
+	for _, a := range l {
+		warn(w, fmt.Sprintf("%s %s v%s is affected by %s (%s severity)", kind, name, version, a.ID, a.Severity))
+	}
+}
+
+func (a Advisory) notice() AdvisoryNotice {
+	return AdvisoryNotice{
+		ID:          a.ID,
+		Severity:    a.Severity,
+		Description: a.Description,
+		URL:         a.URL,
+	}
+}
+
+// touchTargets marks everything an advisory affects as changed, so
+// that their version records pick up (or drop) the advisory.
+func (a Advisory) touchTargets(d *db.DB) {
+	for _, t := range a.Affects {
+		touch(d, t.Kind, t.Name)
+	}
+}
+
+func CreateAdvisory(d *db.DB, a Advisory) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	n, err := d.Count(`SELECT * FROM advisories WHERE id = $1`, a.ID)
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		return fmt.Errorf("advisory %s already exists", a.ID)
+	}
+
+	err = d.Exec(`INSERT INTO advisories (id, severity, description, url, created) VALUES ($1, $2, $3, $4, $5)`,
+		a.ID, a.Severity, a.Description, a.URL, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if err = insertAdvisoryTargets(d, a); err != nil {
+		return err
+	}
+
+	a.touchTargets(d)
+	return nil
+}
+
+func UpdateAdvisory(d *db.DB, a Advisory) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	old, err := FindAdvisory(d, a.ID)
+	if err != nil {
+		return err
+	}
+
+	err = d.Exec(`UPDATE advisories SET severity = $1, description = $2, url = $3 WHERE id = $4`,
+		a.Severity, a.Description, a.URL, a.ID)
+	if err != nil {
+		return err
+	}
+	err = d.Exec(`DELETE FROM advisory_targets WHERE advisory = $1`, a.ID)
+	if err != nil {
+		return err
+	}
+	if err = insertAdvisoryTargets(d, a); err != nil {
+		return err
+	}
+
+	old.touchTargets(d)
+	a.touchTargets(d)
+	return nil
+}
+
+func insertAdvisoryTargets(d *db.DB, a Advisory) error {
+	for _, t := range a.Affects {
+		if t.Versions == nil {
+			t.Versions = []string{}
+		}
+		b, err := json.Marshal(t.Versions)
+		if err != nil {
+			return err
+		}
+		err = d.Exec(`INSERT INTO advisory_targets (advisory, kind, name, versions) VALUES ($1, $2, $3, $4)`,
+			a.ID, t.Kind, t.Name, string(b))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func DeleteAdvisory(d *db.DB, id string) error {
+	a, err := FindAdvisory(d, id)
+	if err != nil {
+		return err
+	}
+
+	err = d.Exec(`DELETE FROM advisory_targets WHERE advisory = $1`, id)
+	if err != nil {
+		return err
+	}
+	err = d.Exec(`DELETE FROM advisories WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	a.touchTargets(d)
+	return nil
+}
+
+func FindAdvisory(d *db.DB, id string) (Advisory, error) {
+	l, err := findAdvisories(d, `WHERE id = $1`, id)
+	if err != nil {
+		return Advisory{}, err
+	}
+	if len(l) == 0 {
+		return Advisory{}, fmt.Errorf("advisory %s not found", id)
+	}
+	return l[0], nil
+}
+
+// FindAdvisories returns all of the advisories that affect the given
+// release or stemcell (all of them, if kind is empty).  If version is
+// not empty, only advisories that affect that version are returned.
+func FindAdvisories(d *db.DB, kind, name, version string) ([]Advisory, error) {
+	if kind == "" {
+		return findAdvisories(d, ``)
+	}
+
+	all, err := findAdvisories(d, `WHERE id IN (SELECT advisory FROM advisory_targets WHERE kind = $1 AND name = $2)`,
+		kind, name)
+	if err != nil {
+		return all, err
+	}
+
+	l := make([]Advisory, 0)
+	for _, a := range all {
+		for _, t := range a.Affects {
+			if t.Kind == kind && t.Name == name && (version == "" || affects(t.Versions, version)) {
+				l = append(l, a)
+				break
+			}
+		}
+	}
+	return l, nil
+}
+
+func findAdvisories(d *db.DB, where string, args ...interface{}) ([]Advisory, error) {
+	l := make([]Advisory, 0)
+
+	/* one row per target, grouped (in order) by advisory */
+	r, err := d.Query(fmt.Sprintf(`
+SELECT a.id, a.severity, a.description, a.url,
+       t.kind, t.name, t.versions
+  FROM advisories a
+  LEFT JOIN advisory_targets t ON t.advisory = a.id
+  %s
+ ORDER BY a.created DESC, a.id ASC, t.kind ASC, t.name ASC`, where), args...)
+	if err != nil {
+		return l, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var a Advisory
+		var kind, name, versions sql.NullString
+		if err = r.Scan(&a.ID, &a.Severity, &a.Description, &a.URL, &kind, &name, &versions); err != nil {
+			return l, err
+		}
+		if len(l) == 0 || l[len(l)-1].ID != a.ID {
+			a.Affects = make([]AdvisoryTarget, 0)
+			l = append(l, a)
+		}
+		if kind.Valid {
+			t := AdvisoryTarget{Kind: kind.String, Name: name.String}
+			json.Unmarshal([]byte(versions.String), &t.Versions)
+			l[len(l)-1].Affects = append(l[len(l)-1].Affects, t)
+		}
+	}
+	return l, nil
+}
+
+// An advisoryIndex maps artifact names to the advisories that affect
+// them, so that version records can be annotated without a query per
+// version.
+type advisoryIndex map[string][]advisoryMatch
+
+type advisoryMatch struct {
+	advisory Advisory
+	versions []string
+}
+
+// loadAdvisories builds the advisoryIndex for a release or stemcell (or,
+// if name is empty, for all of them).  It is cached right alongside the
+// version records it annotates, since anything that changes which
+// advisories affect an artifact touch()es it.
+func loadAdvisories(d *db.DB, kind, name string) (advisoryIndex, error) {
+	v, err := cache.Fetch(kind, name, "advisories", func() (interface{}, error) {
+		idx := make(advisoryIndex)
+
+		where, args := `WHERE t.kind = $1`, []interface{}{kind}
+		if name != "" {
+			where, args = `WHERE t.kind = $1 AND t.name = $2`, append(args, name)
+		}
+		l, err := findAdvisories(d, where, args...)
+		if err != nil {
+			return idx, err
+		}
+		for _, a := range l {
+			for _, t := range a.Affects {
+				idx[t.Name] = append(idx[t.Name], advisoryMatch{a, t.Versions})
+			}
+		}
+		return idx, nil
+	})
+	if err != nil {
+		return make(advisoryIndex), err
+	}
+	return v.(advisoryIndex), nil
+}
+
+func (idx advisoryIndex) notices(name, version string) []AdvisoryNotice {
+	var l []AdvisoryNotice
+	for _, x := range idx[name] {
+		if affects(x.versions, version) {
+			l = append(l, x.advisory.notice())
+		}
+	}
+	return l
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-db"
+)
+
+// An alias is an extra name for a release or stemcell, left behind
+// when it gets renamed (or added by hand), so that anything still
+// using the old name keeps working.  Aliases always point at the
+// canonical name, never at another alias.
+
+// AliasOf returns the canonical name of the release or stemcell that
+// name is an alias for, or "" if name is not an alias.
+func AliasOf(d *db.DB, kind, name string) (string, error) {
+	r, err := d.Query(`SELECT target FROM aliases WHERE kind = $1 AND name = $2`, kind, name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	var target string
+	if r.Next() {
+		if err = r.Scan(&target); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+func FindAliases(d *db.DB, kind, name string) ([]string, error) {
+	l := make([]string, 0)
+
+	r, err := d.Query(`SELECT name FROM aliases WHERE kind = $1 AND target = $2 ORDER BY name`, kind, name)
+	if err != nil {
+		return l, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var alias string
+		if err = r.Scan(&alias); err != nil {
+			return l, err
+		}
+		l = append(l, alias)
+	}
+	return l, nil
+}
+
+// available checks that name can be given to a release or stemcell
+// (as its name, or as an alias), i.e. that nothing else is using it.
+func available(d *db.DB, kind, name string) error {
+	if name == "" || name == "latest" {
+		return fmt.Errorf("invalid %s name '%s'", kind, name)
+	}
+
+	n, err := d.Count(fmt.Sprintf(`SELECT * FROM %ss WHERE name = $1`, kind), name)
+	if err != nil {
+		return err
+	}
+	if n != 0 {
+		return fmt.Errorf("%s '%s' already exists", kind, name)
+	}
+
+	target, err := AliasOf(d, kind, name)
+	if err != nil {
+		return err
+	}
+	if target != "" {
+		return fmt.Errorf("'%s' is already an alias of %s '%s'", name, kind, target)
+	}
+	return nil
+}
+
+func CreateAlias(d *db.DB, kind, name, alias string) error {
+	n, err := d.Count(fmt.Sprintf(`SELECT * FROM %ss WHERE name = $1`, kind), name)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s '%s' not found", kind, name)
+	}
+	if err = available(d, kind, alias); err != nil {
+		return err
+	}
+
+	err = d.Exec(`INSERT INTO aliases (kind, name, target, created) VALUES ($1, $2, $3, $4)`,
+		kind, alias, name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	touch(d, kind, alias)
+	touch(d, kind, name)
+	return nil
+}
+
+func DeleteAlias(d *db.DB, kind, name, alias string) error {
+	n, err := d.Count(`SELECT * FROM aliases WHERE kind = $1 AND name = $2 AND target = $3`, kind, alias, name)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("'%s' is not an alias of %s '%s'", alias, kind, name)
+	}
+
+	err = d.Exec(`DELETE FROM aliases WHERE kind = $1 AND name = $2`, kind, alias)
+	if err != nil {
+		return err
+	}
+
+	touch(d, kind, alias)
+	touch(d, kind, name)
+	return nil
+}
+
+// dropAliases removes all of the aliases of a release or stemcell that
+// is going away.
+func dropAliases(d *db.DB, kind, name string) error {
+	aliases, err := FindAliases(d, kind, name)
+	if err != nil {
+		return err
+	}
+
+	err = d.Exec(`DELETE FROM aliases WHERE kind = $1 AND target = $2`, kind, name)
+	if err != nil {
+		return err
+	}
+
+	for _, alias := range aliases {
+		touch(d, kind, alias)
+	}
+	return nil
+}
+
+// RenameArtifact gives a release or stemcell (and all of its versions)
+// a new name, and keeps the old name around as an alias.  Any aliases
+// of the old name are carried over to the new one.  It all happens in
+// one transaction, so that nothing is ever left half-renamed.
+func RenameArtifact(d *db.DB, kind, name, to string) error {
+	n, err := d.Count(fmt.Sprintf(`SELECT * FROM %ss WHERE name = $1`, kind), name)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s '%s' not found", kind, name)
+	}
+
+	/* renaming something back to one of its own aliases is fine;
+	   that alias just goes away. */
+	target, err := AliasOf(d, kind, to)
+	if err != nil {
+		return err
+	}
+	reclaim := target == name
+	if !reclaim {
+		if err = available(d, kind, to); err != nil {
+			return err
+		}
+	}
+
+	err = transaction(d, func(tx *sql.Tx) error {
+		if reclaim {
+			if _, err := tx.Exec(`DELETE FROM aliases WHERE kind = $1 AND name = $2`, kind, to); err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{kind + "s", kind + "_versions"} {
+			if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET name = $1 WHERE name = $2`, table), to, name); err != nil {
+				return err
+			}
+		}
+		for _, table := range []string{"advisory_targets", "checks", "downloads"} {
+			if _, err := tx.Exec(fmt.Sprintf(`UPDATE %s SET name = $1 WHERE kind = $2 AND name = $3`, table), to, kind, name); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(`UPDATE aliases SET target = $1 WHERE kind = $2 AND target = $3`, to, kind, name); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO aliases (kind, name, target, created) VALUES ($1, $2, $3, $4)`,
+			kind, name, to, time.Now().Unix())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	/* only once it's all committed, so nothing caches a half-renamed view */
+	touch(d, kind, name)
+	touch(d, kind, to)
+	return nil
+}
+
+var aliasable = regexp.MustCompile(`^/v1/(release|stemcell)/([^/]+)(/.*)?$`)
+
+// resolveAlias rewrites requests that name a release or stemcell by one
+// of its aliases so that they refer to the canonical name instead, and
+// returns that canonical name (or "" if no alias was involved).
+// Tarball downloads are permanently redirected instead, so that tools
+// following them learn the new name; if that happens, or the request
+// is otherwise dealt with, handled is true.
+func resolveAlias(d *db.DB, w http.ResponseWriter, r *http.Request, kind string) (canonical string, handled bool) {
+	m := aliasable.FindStringSubmatch(r.URL.Path)
+	if m == nil || m[1] != kind || m[2] == "latest" {
+		return "", false
+	}
+	alias, rest := m[2], m[3]
+
+	v, err := cache.Fetch(kind, alias, "alias", func() (interface{}, error) {
+		return AliasOf(d, kind, alias)
+	})
+	if err != nil {
+		bail(w, err)
+		return "", true
+	}
+	canonical = v.(string)
+	if canonical == "" {
+		return "", false
+	}
+
+	path := fmt.Sprintf("/v1/%s/%s%s", kind, canonical, rest)
+	switch {
+	case r.Method == "DELETE" && rest == "":
+		respond(w, nil, 400, fmt.Sprintf("'%s' is an alias of %s '%s'; remove it with DELETE /v1/%s/%s/aliases/%s",
+			alias, kind, canonical, kind, canonical, alias))
+		return "", true
+
+	case (r.Method == "GET" || r.Method == "HEAD") && strings.HasSuffix(rest, ".tgz"):
+		if r.URL.RawQuery != "" {
+			path = path + "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, path, http.StatusMovedPermanently)
+		return "", true
+	}
+
+	r.URL.Path = path
+	return canonical, false
+}
+
+// aliased marks the release or stemcell record(s) in v as having been
+// looked up by an alias of canonical.  Records that come out of the
+// cache are shared, so they are copied rather than modified.
+func aliased(v interface{}, canonical string) interface{} {
+	if canonical == "" {
+		return v
+	}
+
+	switch o := v.(type) {
+	case Release:
+		o.AliasOf = canonical
+		return o
+	case Stemcell:
+		o.AliasOf = canonical
+		return o
+	case []Release:
+		l := make([]Release, len(o))
+		for i := range o {
+			l[i] = o[i]
+			l[i].AliasOf = canonical
+		}
+		return l
+	case []Stemcell:
+		l := make([]Stemcell, len(o))
+		for i := range o {
+			l[i] = o[i]
+			l[i].AliasOf = canonical
+		}
+		return l
+	}
+	return v
+}
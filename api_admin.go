@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+type AdminAPI struct {
+	db *db.DB
+}
+
+func (api AdminAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("RECV: %s %s", r.Method, r.URL.Path)
+	switch {
+	case match(r, `GET /v1/export`):
+		if !authed(w, r) {
+			return
+		}
+		log.Debugf("exporting the entire index")
+		snapshot, err := ExportSnapshot(api.db)
+		if err != nil {
+			bail(w, err)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" && strings.Contains(r.Header.Get("Accept"), "yaml") {
+			format = "yaml"
+		}
+		b, ctype, err := encodeSnapshot(snapshot, format)
+		if err != nil {
+			bail(w, err)
+			return
+		}
+		w.Header().Set("Content-type", ctype)
+		w.WriteHeader(200)
+		w.Write(b)
+		return
+
+	case match(r, `POST /v1/import`):
+		if !authed(w, r) {
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			bail(w, err)
+			return
+		}
+		snapshot, err := decodeSnapshot(b)
+		if err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid import document: %s", err))
+			return
+		}
+
+		mode := r.URL.Query().Get("mode")
+		if mode != "" && mode != "merge" && mode != "replace" {
+			respond(w, nil, 400, fmt.Sprintf("invalid import mode '%s' (must be 'merge' or 'replace')", mode))
+			return
+		}
+		dryrun := r.URL.Query().Get("dry_run") == "true"
+
+		log.Debugf("importing index (mode %s, dry run %t)", mode, dryrun)
+		changes, err := Import(api.db, snapshot, mode == "replace", dryrun)
+		respond(w, err, 200, struct {
+			DryRun  bool     `json:"dry_run"`
+			Changes []Change `json:"changes"`
+		}{DryRun: dryrun, Changes: changes})
+		return
+	}
+
+	w.WriteHeader(404)
+}
+
+func encodeSnapshot(s Snapshot, format string) ([]byte, string, error) {
+	switch format {
+	case "", "json":
+		b, err := json.MarshalIndent(s, "", "  ")
+		return append(b, '\n'), "application/json", err
+	case "yaml", "yml":
+		b, err := toYAML(s)
+		return b, "application/x-yaml", err
+	}
+	return nil, "", fmt.Errorf("unrecognized export format '%s' (must be 'json' or 'yaml')", format)
+}
+
+// decodeSnapshot reads an export document, in either JSON or YAML.
+func decodeSnapshot(b []byte) (Snapshot, error) {
+	var s Snapshot
+	var err error
+
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		err = json.Unmarshal(b, &s)
+	} else {
+		err = fromYAML(b, &s)
+	}
+	return s, err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+type AdvisoryAPI struct {
+	db *db.DB
+}
+
+func (api AdvisoryAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("RECV: %s %s", r.Method, r.URL.Path)
+	switch {
+	case match(r, `GET /v1/advisories`):
+		var kind, name, version string
+		if affects := r.URL.Query().Get("affects"); affects != "" {
+			m := regexp.MustCompile(`^(release|stemcell)/([^@]+)(?:@(.+))?$`).FindStringSubmatch(affects)
+			if m == nil {
+				respond(w, nil, 400, fmt.Sprintf("invalid affects '%s' (must be 'release/name[@version]' or 'stemcell/name[@version]')", affects))
+				return
+			}
+			kind, name, version = m[1], m[2], m[3]
+		}
+		log.Debugf("retrieving advisories (affecting %s '%s' v%s)", kind, name, version)
+		advisories, err := FindAdvisories(api.db, kind, name, version)
+		respond(w, err, 200, advisories)
+		return
+
+	case match(r, `POST /v1/advisories`):
+		if !authed(w, r) {
+			return
+		}
+		var a Advisory
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid advisory: %s", err))
+			return
+		}
+		if err := a.validate(); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+		log.Debugf("creating advisory %s", a.ID)
+		err := CreateAdvisory(api.db, a)
+		respond(w, err, 200, "created")
+		return
+
+	case match(r, `GET /v1/advisories/[^/]+`):
+		id := extract(r, `/v1/advisories/([^/]+)`)
+		log.Debugf("retrieving advisory %s", id)
+		a, err := FindAdvisory(api.db, id)
+		if err != nil {
+			respond(w, nil, 404, err.Error())
+			return
+		}
+		respond(w, nil, 200, a)
+		return
+
+	case match(r, `PUT /v1/advisories/[^/]+`):
+		if !authed(w, r) {
+			return
+		}
+		var a Advisory
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid advisory: %s", err))
+			return
+		}
+		a.ID = extract(r, `/v1/advisories/([^/]+)`)
+		if err := a.validate(); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+		log.Debugf("updating advisory %s", a.ID)
+		err := UpdateAdvisory(api.db, a)
+		respond(w, err, 200, "updated")
+		return
+
+	case match(r, `DELETE /v1/advisories/[^/]+`):
+		if !authed(w, r) {
+			return
+		}
+		id := extract(r, `/v1/advisories/([^/]+)`)
+		log.Debugf("deleting advisory %s", id)
+		err := DeleteAdvisory(api.db, id)
+		respond(w, err, 200, "deleted")
+		return
+	}
+
+	w.WriteHeader(404)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/jhunt/go-db"
@@ -15,9 +16,19 @@ type ReleaseAPI struct {
 
 func (api ReleaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("RECV: %s %s", r.Method, r.URL.Path)
+	aliasOf, handled := resolveAlias(api.db, w, r, "release")
+	if handled {
+		return
+	}
+
 	switch {
 	case match(r, `GET /v1/release`):
-		releases, err := FindAllReleases(api.db)
+		if notModified(w, r, CollectionRevision(api.db, "release")) {
+			return
+		}
+		releases, err := cache.Fetch("release", "", "all", func() (interface{}, error) {
+			return FindAllReleases(api.db)
+		})
 		respond(w, err, 200, releases)
 		return
 
@@ -26,27 +37,87 @@ func (api ReleaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var payload struct {
-			Name string `json:"name"`
-			URL  string `json:"url"`
+			Name         string   `json:"name"`
+			URL          string   `json:"url"`
+			URLs         []string `json:"urls"`
+			Mirror       bool     `json:"mirror"`
+			SignatureURL string   `json:"signature_url"`
+			TrustedKeys  []string `json:"trusted_keys"`
+			GitHub       string   `json:"github"`
 		}
 
 		json.NewDecoder(r.Body).Decode(&payload)
+		if err := checkVerification("release", payload.SignatureURL, payload.TrustedKeys); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+		if payload.URLs != nil {
+			if payload.URL != "" {
+				respond(w, nil, 400, "specify either url or urls, not both")
+				return
+			}
+			if _, _, err := checkTemplates("release", payload.URLs); err != nil {
+				respond(w, nil, 400, err.Error())
+				return
+			}
+			payload.URL = payload.URLs[0]
+		}
 		log.Debugf("creating release '%s' at '%s'", payload.Name, payload.URL)
-		err := CreateRelease(api.db, payload.Name, payload.URL)
+		err := CreateRelease(api.db, payload.Name, payload.URL, payload.Mirror)
+		if err == nil && len(payload.URLs) > 1 {
+			err = setTemplates(api.db, "release", payload.Name, payload.URLs)
+		}
+		if err == nil && (payload.SignatureURL != "" || len(payload.TrustedKeys) > 0) {
+			err = setVerification(api.db, "release", payload.Name, payload.SignatureURL, payload.TrustedKeys)
+		}
+		if err == nil && payload.GitHub != "" {
+			err = SetReleaseGitHub(api.db, payload.Name, payload.GitHub)
+		}
 		respond(w, err, 200, "success")
 		return
 
 	case match(r, `GET /v1/release/latest`):
+		if notModified(w, r, CollectionRevision(api.db, "release")) {
+			return
+		}
 		log.Debugf("retrieving latest versions of all releases")
-		releases, err := FindLatestReleaseVersions(api.db)
+		releases, err := cache.Fetch("release", "", "latest", func() (interface{}, error) {
+			return FindLatestReleaseVersions(api.db)
+		})
 		respond(w, err, 200, releases)
 		return
 
 	case match(r, `GET /v1/release/[^/]+`):
 		name := extract(r, `/v1/release/([^/]+)$`)
+		since, err := parseDate("since", r.URL.Query().Get("since"))
+		if err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+		if notModified(w, r, ArtifactRevision(api.db, "release", name)) {
+			return
+		}
 		log.Debugf("retrieving all versions of release '%s'", name)
-		releases, err := FindAllReleaseVersions(api.db, name)
-		respond(w, err, 200, releases)
+		releases, err := cache.Fetch("release", name, "versions", func() (interface{}, error) {
+			return FindAllReleaseVersions(api.db, name)
+		})
+		respond(w, err, 200, aliased(seenSince(releases, since), aliasOf))
+		return
+
+	case match(r, `PATCH /v1/release/[^/]+`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/release/([^/]+)`)
+		var patch ArtifactPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+			return
+		}
+		log.Debugf("updating release '%s'", name)
+		patch.RequestID = requestID(r)
+		err := PatchArtifact(api.db, "release", name, patch)
+		respond(w, err, 200, "updated")
 		return
 
 	case match(r, `DELETE /v1/release/[^/]+`):
@@ -59,51 +130,246 @@ func (api ReleaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		respond(w, err, 200, "deleted")
 		return
 
-	case match(r, `GET /v1/release/[^/]+/v/[^/]+\.tgz`):
+	case match(r, `(GET|HEAD) /v1/release/[^/]+/v/[^/]+\.tgz`):
 		name := extract(r, `/v1/release/([^/]+)/v/[^/]+\.tgz`)
 		vers := extract(r, `/v1/release/[^/]+/v/([^/]+)\.tgz`)
+		if notModified(w, r, ArtifactRevision(api.db, "release", name)) {
+			return
+		}
 		log.Debugf("retrieving version '%s' (tarball) of release '%s'", vers, name)
-		release, err := FindReleaseVersion(api.db, name, vers)
+		v, err := cache.Fetch("release", name, "v/"+vers, func() (interface{}, error) {
+			return FindReleaseVersion(api.db, name, vers)
+		})
 		if err != nil {
 			bail(w, err)
 			return
 		}
-		w.Header().Set("Location", release.URL)
-		w.WriteHeader(303)
+		release := v.(Release)
+		warnAdvisories(w, "release", name, vers, release.Advisories)
+		warnYanked(w, "release", name, vers, release.Yanked)
+		downloads.Count(r, "release", name, release.Version)
+		deliver(w, r, release.URLs, release.SHA1, release.SHA256)
+		return
+
+	case match(r, `GET /v1/release/[^/]+/v/[^/]+/notes`):
+		name := extract(r, `/v1/release/([^/]+)/v/[^/]+/notes`)
+		vers := extract(r, `/v1/release/[^/]+/v/([^/]+)/notes`)
+		w.Header().Set("Vary", "Accept")
+		if notModified(w, r, ArtifactRevision(api.db, "release", name).As(notesFormat(r))) {
+			return
+		}
+		log.Debugf("retrieving release notes for version '%s' of release '%s'", vers, name)
+		v, err := cache.Fetch("release", name, "notes/"+vers, func() (interface{}, error) {
+			return FindReleaseNotes(api.db, name, vers)
+		})
+		if err != nil || !wantsMarkdown(r) {
+			respond(w, err, 200, v)
+			return
+		}
+		w.Header().Set("Content-type", "text/markdown")
+		w.WriteHeader(200)
+		w.Write(markdown([]ReleaseNotes{v.(ReleaseNotes)}))
+		return
+
+	case match(r, `GET /v1/release/[^/]+/notes`):
+		name := extract(r, `/v1/release/([^/]+)/notes`)
+		from := r.URL.Query().Get("from")
+		to := r.URL.Query().Get("to")
+		if from == "" {
+			respond(w, nil, 400, "missing required 'from' version")
+			return
+		}
+		w.Header().Set("Vary", "Accept")
+		if notModified(w, r, ArtifactRevision(api.db, "release", name).As(notesFormat(r))) {
+			return
+		}
+		log.Debugf("retrieving release notes for release '%s' from v%s to v%s", name, from, to)
+		v, err := cache.Fetch("release", name, "notes/"+from+".."+to, func() (interface{}, error) {
+			return FindReleaseNotesRange(api.db, name, from, to)
+		})
+		if err != nil || !wantsMarkdown(r) {
+			respond(w, err, 200, v)
+			return
+		}
+		w.Header().Set("Content-type", "text/markdown")
+		w.WriteHeader(200)
+		w.Write(markdown(v.([]ReleaseNotes)))
 		return
 
 	case match(r, `GET /v1/release/[^/]+/v/[^/]+`):
 		name := extract(r, `/v1/release/([^/]+)/v/[^/]+`)
 		vers := extract(r, `/v1/release/[^/]+/v/([^/]+)`)
+		if notModified(w, r, ArtifactRevision(api.db, "release", name)) {
+			return
+		}
 		log.Debugf("retrieving version '%s' of release '%s'", vers, name)
-		release, err := FindReleaseVersion(api.db, name, vers)
-		respond(w, err, 200, release)
+		release, err := cache.Fetch("release", name, "v/"+vers, func() (interface{}, error) {
+			return FindReleaseVersion(api.db, name, vers)
+		})
+		if err == nil {
+			warnAdvisories(w, "release", name, vers, release.(Release).Advisories)
+			warnYanked(w, "release", name, vers, release.(Release).Yanked)
+		}
+		respond(w, err, 200, aliased(release, aliasOf))
+		return
+
+	case match(r, `GET /v1/release/[^/]+/preview`):
+		name := extract(r, `/v1/release/([^/]+)/preview`)
+		vers := r.URL.Query().Get("version")
+		if vers == "" {
+			respond(w, nil, 400, "missing required 'version'")
+			return
+		}
+		l := r.URL.Query()["template"]
+		for _, t := range l {
+			if err := checkTemplate("release", t); err != nil {
+				respond(w, nil, 400, err.Error())
+				return
+			}
+		}
+		log.Debugf("previewing urls for version '%s' of release '%s'", vers, name)
+		preview, err := PreviewTemplates(api.db, "release", name, vers, l)
+		respond(w, err, 200, preview)
 		return
 
 	case match(r, `GET /v1/release/[^/]+/metadata`):
 		name := extract(r, `/v1/release/([^/]+)/metadata`)
+		if notModified(w, r, ArtifactRevision(api.db, "release", name)) {
+			return
+		}
 		log.Debugf("retrieving latest version of release '%s'", name)
-		release, err := FindRelease(api.db, name)
-		respond(w, err, 200, release)
+		release, err := cache.Fetch("release", name, "metadata", func() (interface{}, error) {
+			return FindRelease(api.db, name)
+		})
+		respond(w, err, 200, aliased(release, aliasOf))
 		return
 
-	case match(r, `GET /v1/release/[^/]+/latest\.tgz`):
+	case match(r, `(GET|HEAD) /v1/release/[^/]+/latest\.tgz`):
 		name := extract(r, `/v1/release/([^/]+)/latest\.tgz`)
+		if notModified(w, r, ArtifactRevision(api.db, "release", name)) {
+			return
+		}
 		log.Debugf("retrieving latest (tarball) version of release '%s'", name)
-		release, err := FindReleaseVersion(api.db, name, "")
+		v, err := cache.Fetch("release", name, "latest", func() (interface{}, error) {
+			return FindReleaseVersion(api.db, name, "")
+		})
 		if err != nil {
 			bail(w, err)
 			return
 		}
-		w.Header().Set("Location", release.URL)
-		w.WriteHeader(303)
+		release := v.(Release)
+		downloads.Count(r, "release", name, release.Version)
+		deliver(w, r, release.URLs, release.SHA1, release.SHA256)
 		return
 
 	case match(r, `GET /v1/release/[^/]+/latest`):
 		name := extract(r, `/v1/release/([^/]+)/latest$`)
+		if notModified(w, r, ArtifactRevision(api.db, "release", name)) {
+			return
+		}
 		log.Debugf("retrieving latest version of release '%s'", name)
-		release, err := FindReleaseVersion(api.db, name, "")
-		respond(w, err, 200, release)
+		release, err := cache.Fetch("release", name, "latest", func() (interface{}, error) {
+			return FindReleaseVersion(api.db, name, "")
+		})
+		respond(w, err, 200, aliased(release, aliasOf))
+		return
+
+	case match(r, `PUT /v1/release/[^/]+/verification`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/release/([^/]+)/verification`)
+		var payload struct {
+			SignatureURL string   `json:"signature_url"`
+			TrustedKeys  []string `json:"trusted_keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+			return
+		}
+		if err := checkVerification("release", payload.SignatureURL, payload.TrustedKeys); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+		log.Debugf("updating upstream signature verification for release '%s'", name)
+		err := setVerification(api.db, "release", name, payload.SignatureURL, payload.TrustedKeys)
+		respond(w, err, 200, "updated")
+		return
+
+	case match(r, `POST /v1/release/[^/]+/rename`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/release/([^/]+)/rename`)
+		var payload struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+			return
+		}
+		log.Debugf("renaming release '%s' to '%s'", name, payload.Name)
+		err := RenameArtifact(api.db, "release", name, payload.Name)
+		respond(w, err, 200, "renamed")
+		return
+
+	case match(r, `GET /v1/release/[^/]+/aliases`):
+		name := extract(r, `/v1/release/([^/]+)/aliases`)
+		log.Debugf("retrieving aliases of release '%s'", name)
+		aliases, err := FindAliases(api.db, "release", name)
+		respond(w, err, 200, aliases)
+		return
+
+	case match(r, `PUT /v1/release/[^/]+/aliases/[^/]+`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/release/([^/]+)/aliases/[^/]+`)
+		alias := extract(r, `/v1/release/[^/]+/aliases/([^/]+)`)
+		log.Debugf("adding alias '%s' for release '%s'", alias, name)
+		err := CreateAlias(api.db, "release", name, alias)
+		respond(w, err, 200, "created")
+		return
+
+	case match(r, `DELETE /v1/release/[^/]+/aliases/[^/]+`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/release/([^/]+)/aliases/[^/]+`)
+		alias := extract(r, `/v1/release/[^/]+/aliases/([^/]+)`)
+		log.Debugf("removing alias '%s' of release '%s'", alias, name)
+		err := DeleteAlias(api.db, "release", name, alias)
+		respond(w, err, 200, "deleted")
+		return
+
+	case match(r, `PUT /v1/release/[^/]+/v/[^/]+/yank`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/release/([^/]+)/v/[^/]+/yank`)
+		vers := extract(r, `/v1/release/[^/]+/v/([^/]+)/yank`)
+		var payload struct {
+			Reason      string `json:"reason"`
+			Replacement string `json:"replacement"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+			return
+		}
+		log.Debugf("yanking version '%s' of release '%s'", vers, name)
+		err := YankVersion(api.db, "release", name, vers, payload.Reason, payload.Replacement)
+		respond(w, err, 200, fmt.Sprintf("v%s yanked", vers))
+		return
+
+	case match(r, `DELETE /v1/release/[^/]+/v/[^/]+/yank`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/release/([^/]+)/v/[^/]+/yank`)
+		vers := extract(r, `/v1/release/[^/]+/v/([^/]+)/yank`)
+		log.Debugf("un-yanking version '%s' of release '%s'", vers, name)
+		err := UnyankVersion(api.db, "release", name, vers)
+		respond(w, err, 200, fmt.Sprintf("v%s restored", vers))
 		return
 
 	case match(r, `PUT /v1/release/[^/]+/v/[^/]+`):
@@ -112,12 +378,50 @@ func (api ReleaseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		name := extract(r, `/v1/release/([^/]+)/v/[^/]+`)
 		vers := extract(r, `/v1/release/[^/]+/v/([^/]+)`)
+		var payload VersionCheck
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && err != io.EOF {
+				respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+				return
+			}
+		}
+		if err := payload.validate(); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
 		log.Debugf("checking for version '%s' of release '%s'", vers, name)
 
-		err := CheckReleaseVersion(api.db, name, vers)
+		if payload.Trusted {
+			if err := trustable(api.db, "release", name); err != nil {
+				respond(w, nil, 400, err.Error())
+				return
+			}
+			if there, err := known(api.db, "release", name, vers); err != nil || there {
+				respond(w, err, 409, fmt.Sprintf("version '%s' of release '%s' is already known, so it cannot be registered before it is checked", vers, name))
+				return
+			}
+		}
+		payload.RequestID = requestID(r)
+		err := CheckReleaseVersion(api.db, name, vers, payload)
+		if payload.Trusted {
+			respond(w, err, 200, "registered")
+			return
+		}
 		respond(w, err, 200, "task started in background")
 		return
 
+	case match(r, `GET /v1/release/[^/]+/v/[^/]+/check`):
+		name := extract(r, `/v1/release/([^/]+)/v/[^/]+/check`)
+		vers := extract(r, `/v1/release/[^/]+/v/([^/]+)/check`)
+		log.Debugf("retrieving check status of version '%s' of release '%s'", vers, name)
+		status, err := FindCheckStatus(api.db, "release", name, vers)
+		if err != nil {
+			respond(w, nil, 404, err.Error())
+			return
+		}
+		respond(w, nil, 200, status)
+		return
+
 	case match(r, `DELETE /v1/release/[^/]+/v/[^/]+`):
 		if !authed(w, r) {
 			return
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 
 	"github.com/jhunt/go-db"
@@ -15,9 +16,19 @@ type StemcellAPI struct {
 
 func (api StemcellAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("RECV: %s %s", r.Method, r.URL.Path)
+	aliasOf, handled := resolveAlias(api.db, w, r, "stemcell")
+	if handled {
+		return
+	}
+
 	switch {
 	case match(r, `GET /v1/stemcell`):
-		stemcells, err := FindAllStemcells(api.db)
+		if notModified(w, r, CollectionRevision(api.db, "stemcell")) {
+			return
+		}
+		stemcells, err := cache.Fetch("stemcell", "", "all", func() (interface{}, error) {
+			return FindAllStemcells(api.db)
+		})
 		respond(w, err, 200, stemcells)
 		return
 
@@ -26,27 +37,83 @@ func (api StemcellAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var payload struct {
-			Name string `json:"name"`
-			URL  string `json:"url"`
+			Name         string   `json:"name"`
+			URL          string   `json:"url"`
+			URLs         []string `json:"urls"`
+			Mirror       bool     `json:"mirror"`
+			SignatureURL string   `json:"signature_url"`
+			TrustedKeys  []string `json:"trusted_keys"`
 		}
 
 		json.NewDecoder(r.Body).Decode(&payload)
+		if err := checkVerification("stemcell", payload.SignatureURL, payload.TrustedKeys); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+		if payload.URLs != nil {
+			if payload.URL != "" {
+				respond(w, nil, 400, "specify either url or urls, not both")
+				return
+			}
+			if _, _, err := checkTemplates("stemcell", payload.URLs); err != nil {
+				respond(w, nil, 400, err.Error())
+				return
+			}
+			payload.URL = payload.URLs[0]
+		}
 		log.Debugf("creating stemcell '%s' at '%s'", payload.Name, payload.URL)
-		err := CreateStemcell(api.db, payload.Name, payload.URL)
+		err := CreateStemcell(api.db, payload.Name, payload.URL, payload.Mirror)
+		if err == nil && len(payload.URLs) > 1 {
+			err = setTemplates(api.db, "stemcell", payload.Name, payload.URLs)
+		}
+		if err == nil && (payload.SignatureURL != "" || len(payload.TrustedKeys) > 0) {
+			err = setVerification(api.db, "stemcell", payload.Name, payload.SignatureURL, payload.TrustedKeys)
+		}
 		respond(w, err, 200, "success")
 		return
 
 	case match(r, `GET /v1/stemcell/latest`):
+		if notModified(w, r, CollectionRevision(api.db, "stemcell")) {
+			return
+		}
 		log.Debugf("retrieving latest versions of all stemcells")
-		stemcells, err := FindLatestStemcellVersions(api.db)
+		stemcells, err := cache.Fetch("stemcell", "", "latest", func() (interface{}, error) {
+			return FindLatestStemcellVersions(api.db)
+		})
 		respond(w, err, 200, stemcells)
 		return
 
 	case match(r, `GET /v1/stemcell/[^/]+`):
 		name := extract(r, `/v1/stemcell/([^/]+)$`)
+		since, err := parseDate("since", r.URL.Query().Get("since"))
+		if err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+		if notModified(w, r, ArtifactRevision(api.db, "stemcell", name)) {
+			return
+		}
 		log.Debugf("retrieving all versions of stemcell '%s'", name)
-		stemcells, err := FindAllStemcellVersions(api.db, name)
-		respond(w, err, 200, stemcells)
+		stemcells, err := cache.Fetch("stemcell", name, "versions", func() (interface{}, error) {
+			return FindAllStemcellVersions(api.db, name)
+		})
+		respond(w, err, 200, aliased(seenSince(stemcells, since), aliasOf))
+		return
+
+	case match(r, `PATCH /v1/stemcell/[^/]+`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/stemcell/([^/]+)`)
+		var patch ArtifactPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+			return
+		}
+		log.Debugf("updating stemcell '%s'", name)
+		patch.RequestID = requestID(r)
+		err := PatchArtifact(api.db, "stemcell", name, patch)
+		respond(w, err, 200, "updated")
 		return
 
 	case match(r, `DELETE /v1/stemcell/[^/]+`):
@@ -59,51 +126,201 @@ func (api StemcellAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		respond(w, err, 200, "deleted")
 		return
 
-	case match(r, `GET /v1/stemcell/[^/]+/v/[^/]+\.tgz`):
+	case match(r, `(GET|HEAD) /v1/stemcell/[^/]+/v/[^/]+\.tgz`):
 		name := extract(r, `/v1/stemcell/([^/]+)/v/[^/]+\.tgz`)
 		vers := extract(r, `/v1/stemcell/[^/]+/v/([^/]+)\.tgz`)
+		if notModified(w, r, ArtifactRevision(api.db, "stemcell", name)) {
+			return
+		}
 		log.Debugf("retrieving version '%s' (tarball) of stemcell '%s'", vers, name)
-		stemcell, err := FindStemcellVersion(api.db, name, vers)
+		v, err := cache.Fetch("stemcell", name, "v/"+vers, func() (interface{}, error) {
+			return FindStemcellVersion(api.db, name, vers)
+		})
 		if err != nil {
 			bail(w, err)
 			return
 		}
-		w.Header().Set("Location", stemcell.URL)
-		w.WriteHeader(303)
+		stemcell := v.(Stemcell)
+		warnAdvisories(w, "stemcell", name, vers, stemcell.Advisories)
+		warnYanked(w, "stemcell", name, vers, stemcell.Yanked)
+		downloads.Count(r, "stemcell", name, stemcell.Version)
+		deliver(w, r, stemcell.URLs, stemcell.SHA1, stemcell.SHA256)
 		return
 
 	case match(r, `GET /v1/stemcell/[^/]+/v/[^/]+`):
 		name := extract(r, `/v1/stemcell/([^/]+)/v/[^/]+`)
 		vers := extract(r, `/v1/stemcell/[^/]+/v/([^/]+)`)
+		if notModified(w, r, ArtifactRevision(api.db, "stemcell", name)) {
+			return
+		}
 		log.Debugf("retrieving version '%s' of stemcell '%s'", vers, name)
-		stemcell, err := FindStemcellVersion(api.db, name, vers)
-		respond(w, err, 200, stemcell)
+		stemcell, err := cache.Fetch("stemcell", name, "v/"+vers, func() (interface{}, error) {
+			return FindStemcellVersion(api.db, name, vers)
+		})
+		if err == nil {
+			warnAdvisories(w, "stemcell", name, vers, stemcell.(Stemcell).Advisories)
+			warnYanked(w, "stemcell", name, vers, stemcell.(Stemcell).Yanked)
+		}
+		respond(w, err, 200, aliased(stemcell, aliasOf))
+		return
+
+	case match(r, `GET /v1/stemcell/[^/]+/preview`):
+		name := extract(r, `/v1/stemcell/([^/]+)/preview`)
+		vers := r.URL.Query().Get("version")
+		if vers == "" {
+			respond(w, nil, 400, "missing required 'version'")
+			return
+		}
+		l := r.URL.Query()["template"]
+		for _, t := range l {
+			if err := checkTemplate("stemcell", t); err != nil {
+				respond(w, nil, 400, err.Error())
+				return
+			}
+		}
+		log.Debugf("previewing urls for version '%s' of stemcell '%s'", vers, name)
+		preview, err := PreviewTemplates(api.db, "stemcell", name, vers, l)
+		respond(w, err, 200, preview)
 		return
 
 	case match(r, `GET /v1/stemcell/[^/]+/metadata`):
 		name := extract(r, `/v1/stemcell/([^/]+)/metadata`)
+		if notModified(w, r, ArtifactRevision(api.db, "stemcell", name)) {
+			return
+		}
 		log.Debugf("retrieving latest version of stemcell '%s'", name)
-		stemcell, err := FindStemcell(api.db, name)
-		respond(w, err, 200, stemcell)
+		stemcell, err := cache.Fetch("stemcell", name, "metadata", func() (interface{}, error) {
+			return FindStemcell(api.db, name)
+		})
+		respond(w, err, 200, aliased(stemcell, aliasOf))
 		return
 
-	case match(r, `GET /v1/stemcell/[^/]+/latest\.tgz`):
+	case match(r, `(GET|HEAD) /v1/stemcell/[^/]+/latest\.tgz`):
 		name := extract(r, `/v1/stemcell/([^/]+)/latest\.tgz`)
+		if notModified(w, r, ArtifactRevision(api.db, "stemcell", name)) {
+			return
+		}
 		log.Debugf("retrieving latest (tarball) version of stemcell '%s'", name)
-		stemcell, err := FindStemcellVersion(api.db, name, "")
+		v, err := cache.Fetch("stemcell", name, "latest", func() (interface{}, error) {
+			return FindStemcellVersion(api.db, name, "")
+		})
 		if err != nil {
 			bail(w, err)
 			return
 		}
-		w.Header().Set("Location", stemcell.URL)
-		w.WriteHeader(303)
+		stemcell := v.(Stemcell)
+		downloads.Count(r, "stemcell", name, stemcell.Version)
+		deliver(w, r, stemcell.URLs, stemcell.SHA1, stemcell.SHA256)
 		return
 
 	case match(r, `GET /v1/stemcell/[^/]+/latest`):
 		name := extract(r, `/v1/stemcell/([^/]+)/latest$`)
+		if notModified(w, r, ArtifactRevision(api.db, "stemcell", name)) {
+			return
+		}
 		log.Debugf("retrieving latest version of stemcell '%s'", name)
-		stemcell, err := FindStemcellVersion(api.db, name, "")
-		respond(w, err, 200, stemcell)
+		stemcell, err := cache.Fetch("stemcell", name, "latest", func() (interface{}, error) {
+			return FindStemcellVersion(api.db, name, "")
+		})
+		respond(w, err, 200, aliased(stemcell, aliasOf))
+		return
+
+	case match(r, `PUT /v1/stemcell/[^/]+/verification`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/stemcell/([^/]+)/verification`)
+		var payload struct {
+			SignatureURL string   `json:"signature_url"`
+			TrustedKeys  []string `json:"trusted_keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+			return
+		}
+		if err := checkVerification("stemcell", payload.SignatureURL, payload.TrustedKeys); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+		log.Debugf("updating upstream signature verification for stemcell '%s'", name)
+		err := setVerification(api.db, "stemcell", name, payload.SignatureURL, payload.TrustedKeys)
+		respond(w, err, 200, "updated")
+		return
+
+	case match(r, `POST /v1/stemcell/[^/]+/rename`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/stemcell/([^/]+)/rename`)
+		var payload struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+			return
+		}
+		log.Debugf("renaming stemcell '%s' to '%s'", name, payload.Name)
+		err := RenameArtifact(api.db, "stemcell", name, payload.Name)
+		respond(w, err, 200, "renamed")
+		return
+
+	case match(r, `GET /v1/stemcell/[^/]+/aliases`):
+		name := extract(r, `/v1/stemcell/([^/]+)/aliases`)
+		log.Debugf("retrieving aliases of stemcell '%s'", name)
+		aliases, err := FindAliases(api.db, "stemcell", name)
+		respond(w, err, 200, aliases)
+		return
+
+	case match(r, `PUT /v1/stemcell/[^/]+/aliases/[^/]+`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/stemcell/([^/]+)/aliases/[^/]+`)
+		alias := extract(r, `/v1/stemcell/[^/]+/aliases/([^/]+)`)
+		log.Debugf("adding alias '%s' for stemcell '%s'", alias, name)
+		err := CreateAlias(api.db, "stemcell", name, alias)
+		respond(w, err, 200, "created")
+		return
+
+	case match(r, `DELETE /v1/stemcell/[^/]+/aliases/[^/]+`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/stemcell/([^/]+)/aliases/[^/]+`)
+		alias := extract(r, `/v1/stemcell/[^/]+/aliases/([^/]+)`)
+		log.Debugf("removing alias '%s' of stemcell '%s'", alias, name)
+		err := DeleteAlias(api.db, "stemcell", name, alias)
+		respond(w, err, 200, "deleted")
+		return
+
+	case match(r, `PUT /v1/stemcell/[^/]+/v/[^/]+/yank`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/stemcell/([^/]+)/v/[^/]+/yank`)
+		vers := extract(r, `/v1/stemcell/[^/]+/v/([^/]+)/yank`)
+		var payload struct {
+			Reason      string `json:"reason"`
+			Replacement string `json:"replacement"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+			return
+		}
+		log.Debugf("yanking version '%s' of stemcell '%s'", vers, name)
+		err := YankVersion(api.db, "stemcell", name, vers, payload.Reason, payload.Replacement)
+		respond(w, err, 200, fmt.Sprintf("v%s yanked", vers))
+		return
+
+	case match(r, `DELETE /v1/stemcell/[^/]+/v/[^/]+/yank`):
+		if !authed(w, r) {
+			return
+		}
+		name := extract(r, `/v1/stemcell/([^/]+)/v/[^/]+/yank`)
+		vers := extract(r, `/v1/stemcell/[^/]+/v/([^/]+)/yank`)
+		log.Debugf("un-yanking version '%s' of stemcell '%s'", vers, name)
+		err := UnyankVersion(api.db, "stemcell", name, vers)
+		respond(w, err, 200, fmt.Sprintf("v%s restored", vers))
 		return
 
 	case match(r, `PUT /v1/stemcell/[^/]+/v/[^/]+`):
@@ -112,12 +329,54 @@ func (api StemcellAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		name := extract(r, `/v1/stemcell/([^/]+)/v/[^/]+`)
 		vers := extract(r, `/v1/stemcell/[^/]+/v/([^/]+)`)
+		var payload VersionCheck
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && err != io.EOF {
+				respond(w, nil, 400, fmt.Sprintf("invalid request: %s", err))
+				return
+			}
+		}
+		if payload.Notes != "" {
+			respond(w, nil, 400, "stemcells do not have release notes")
+			return
+		}
+		if err := payload.validate(); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
 		log.Debugf("checking for version '%s' of stemcell '%s'", vers, name)
 
-		err := CheckStemcellVersion(api.db, name, vers)
+		if payload.Trusted {
+			if err := trustable(api.db, "stemcell", name); err != nil {
+				respond(w, nil, 400, err.Error())
+				return
+			}
+			if there, err := known(api.db, "stemcell", name, vers); err != nil || there {
+				respond(w, err, 409, fmt.Sprintf("version '%s' of stemcell '%s' is already known, so it cannot be registered before it is checked", vers, name))
+				return
+			}
+		}
+		payload.RequestID = requestID(r)
+		err := CheckStemcellVersion(api.db, name, vers, payload)
+		if payload.Trusted {
+			respond(w, err, 200, "registered")
+			return
+		}
 		respond(w, err, 200, "task started in background")
 		return
 
+	case match(r, `GET /v1/stemcell/[^/]+/v/[^/]+/check`):
+		name := extract(r, `/v1/stemcell/([^/]+)/v/[^/]+/check`)
+		vers := extract(r, `/v1/stemcell/[^/]+/v/([^/]+)/check`)
+		log.Debugf("retrieving check status of version '%s' of stemcell '%s'", vers, name)
+		status, err := FindCheckStatus(api.db, "stemcell", name, vers)
+		if err != nil {
+			respond(w, nil, 404, err.Error())
+			return
+		}
+		respond(w, nil, 200, status)
+		return
+
 	case match(r, `DELETE /v1/stemcell/[^/]+/v/[^/]+`):
 		if !authed(w, r) {
 			return
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+// A Blobstore keeps mirrored copies of release and stemcell tarballs,
+// content-addressed by their SHA256 digest.
+//
+// Get returns a seekable handle on the blob, so that it can be served
+// with support for Range requests, or an error satisfying
+// os.IsNotExist() for blobs that it doesn't have.  URL returns a
+// (pre-signed, if need be) URL that clients can download the blob
+// from directly, or the empty string if the backend can't do that and
+// the blob has to be streamed.
+type Blobstore interface {
+	Put(digest string, r io.Reader, size int64) error
+	Get(digest string) (Blob, error)
+	Exists(digest string) (bool, error)
+	Delete(digest string) error
+	URL(digest string, ttl time.Duration) (string, error)
+}
+
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+/* blobs is nil unless mirroring has been configured */
+var blobs Blobstore
+
+func validDigest(digest string) error {
+	if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(digest) {
+		return fmt.Errorf("invalid blob digest '%s'", digest)
+	}
+	return nil
+}
+
+// LocalBlobstore keeps blobs in a directory on local disk.
+type LocalBlobstore struct {
+	root string
+}
+
+func NewLocalBlobstore(root string) (*LocalBlobstore, error) {
+	if err := os.MkdirAll(filepath.Join(root, "tmp"), 0755); err != nil {
+		return nil, err
+	}
+	return &LocalBlobstore{root: root}, nil
+}
+
+func (b *LocalBlobstore) path(digest string) (string, error) {
+	if err := validDigest(digest); err != nil {
+		return "", err
+	}
+	return filepath.Join(b.root, digest[0:2], digest), nil
+}
+
+// Put stores the contents of r under digest.  The blob only becomes
+// visible once all of it has been written.
+func (b *LocalBlobstore) Put(digest string, r io.Reader, size int64) error {
+	path, err := b.path(digest)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Join(b.root, "tmp"), "blob")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (b *LocalBlobstore) Get(digest string) (Blob, error) {
+	path, err := b.path(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (b *LocalBlobstore) Exists(digest string) (bool, error) {
+	path, err := b.path(digest)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *LocalBlobstore) Delete(digest string) error {
+	path, err := b.path(digest)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (b *LocalBlobstore) URL(digest string, ttl time.Duration) (string, error) {
+	return "", nil
+}
+
+// mirrored returns the digests of all mirrorable versions of the named
+// release or stemcell.  If version is empty, all versions are
+// considered.
+func mirrored(d *db.DB, kind, name, version string) []string {
+	l := make([]string, 0)
+	if blobs == nil {
+		return l
+	}
+
+	where := ""
+	args := []interface{}{name}
+	if version != "" {
+		where = "AND version = $2"
+		args = append(args, version)
+	}
+
+	r, err := d.Query(fmt.Sprintf(`
+SELECT sha256 FROM %s_versions
+ WHERE name = $1 AND sha256 <> '' %s`, kind, where), args...)
+	if err != nil {
+		log.Errorf("unable to determine mirrored blobs for %s '%s': %s", kind, name, err)
+		return l
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var digest string
+		if err = r.Scan(&digest); err == nil {
+			l = append(l, digest)
+		}
+	}
+	return l
+}
+
+// unmirror removes those of the given blobs that are no longer
+// referenced by any version of any release or stemcell.
+func unmirror(d *db.DB, digests []string) {
+	if blobs == nil {
+		return
+	}
+
+	for _, digest := range digests {
+		n, err := d.Count(`
+SELECT sha256 FROM release_versions  WHERE sha256 = $1
+ UNION ALL
+SELECT sha256 FROM stemcell_versions WHERE sha256 = $1`, digest)
+		if err != nil || n != 0 {
+			continue
+		}
+
+		log.Debugf("removing unreferenced blob %s from the mirror", digest)
+		if err = blobs.Delete(digest); err != nil {
+			log.Errorf("unable to remove blob %s from the mirror: %s", digest, err)
+		}
+	}
+}
+
+// deliver sends the client to (or streams them) the mirrored copy of
+// a tarball, if we have one, and otherwise redirects them to the first
+// healthy upstream url.  Streamed blobs honor Range / If-Range requests, so
+// that interrupted downloads can be resumed.
+func deliver(w http.ResponseWriter, r *http.Request, urls []string, sha1, sha256 string) {
+	if dg := digests(sha1, sha256); dg != "" {
+		w.Header().Set("Digest", dg)
+	}
+
+	if blobs != nil && sha256 != "" {
+		if there, err := blobs.Exists(sha256); err != nil {
+			log.Errorf("unable to check for blob %s in the mirror: %s", sha256, err)
+
+		} else if there {
+			if direct, err := blobs.URL(sha256, 15*time.Minute); err != nil {
+				log.Errorf("unable to generate a URL for blob %s: %s", sha256, err)
+
+			} else if direct != "" {
+				log.Debugf("redirecting to blob %s in the mirror", sha256)
+				w.Header().Set("Location", direct)
+				w.WriteHeader(303)
+				return
+			}
+
+			f, err := blobs.Get(sha256)
+			if err == nil {
+				defer f.Close()
+				log.Debugf("serving blob %s from the mirror", sha256)
+
+				/* the blob is content-addressed, so its digest
+				   makes for the best possible (strong) ETag */
+				w.Header().Set("ETag", fmt.Sprintf(`"%s"`, sha256))
+				w.Header().Set("Content-Type", "application/gzip")
+				http.ServeContent(w, r, sha256+".tgz", time.Time{}, f)
+				return
+			}
+			if !os.IsNotExist(err) {
+				log.Errorf("unable to retrieve blob %s from the mirror: %s", sha256, err)
+			}
+		}
+	}
+
+	w.Header().Set("Location", pick(urls))
+	w.WriteHeader(303)
+}
+
+// digests formats the given hex checksums as the value of an RFC 3230
+// Digest header.
+func digests(sha1, sha256 string) string {
+	l := make([]string, 0)
+	if b, err := hex.DecodeString(sha256); err == nil && sha256 != "" {
+		l = append(l, "sha-256="+base64.StdEncoding.EncodeToString(b))
+	}
+	if b, err := hex.DecodeString(sha1); err == nil && sha1 != "" {
+		l = append(l, "sha="+base64.StdEncoding.EncodeToString(b))
+	}
+	return strings.Join(l, ",")
+}
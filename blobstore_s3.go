@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Blobstore keeps blobs in a bucket of an S3-compatible object
+// store (AWS S3 proper, MinIO, Ceph RGW, etc.), using path-style
+// addressing and AWS Signature Version 4.
+type S3Blobstore struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	/* if set, clients are redirected to pre-signed URLs rather
+	   than having genesis-index stream the blobs to them. */
+	Presign bool
+
+	client *http.Client
+}
+
+func NewS3Blobstore(endpoint, bucket, region, akey, skey string, presign bool) (*S3Blobstore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, fmt.Errorf("both an S3 endpoint and a bucket name are required")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Blobstore{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: akey,
+		SecretKey: skey,
+		Presign:   presign,
+		client:    &http.Client{},
+	}, nil
+}
+
+func (s *S3Blobstore) url(digest string) (*url.URL, error) {
+	if err := validDigest(digest); err != nil {
+		return nil, err
+	}
+	return url.Parse(fmt.Sprintf("%s/%s/%s/%s", s.Endpoint, s.Bucket, digest[0:2], digest))
+}
+
+func (s *S3Blobstore) do(method, digest string, body io.Reader, size int64) (*http.Response, error) {
+	return s.request(method, digest, body, size, "")
+}
+
+func (s *S3Blobstore) request(method, digest string, body io.Reader, size int64, rng string) (*http.Response, error) {
+	u, err := s.url(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	s.sign(req, time.Now())
+	return s.client.Do(req)
+}
+
+func (s *S3Blobstore) Put(digest string, r io.Reader, size int64) error {
+	res, err := s.do("PUT", digest, r, size)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("PUT of blob %s returned %s", digest, res.Status)
+	}
+	return nil
+}
+
+func (s *S3Blobstore) Get(digest string) (Blob, error) {
+	res, err := s.do("HEAD", digest, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+		return &s3Blob{store: s, digest: digest, size: res.ContentLength}, nil
+	case 404:
+		return nil, os.ErrNotExist
+	}
+	return nil, fmt.Errorf("HEAD of blob %s returned %s", digest, res.Status)
+}
+
+func (s *S3Blobstore) Exists(digest string) (bool, error) {
+	res, err := s.do("HEAD", digest, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case 200:
+		return true, nil
+	case 404:
+		return false, nil
+	}
+	return false, fmt.Errorf("HEAD of blob %s returned %s", digest, res.Status)
+}
+
+func (s *S3Blobstore) Delete(digest string) error {
+	res, err := s.do("DELETE", digest, nil, 0)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 200 && res.StatusCode != 204 && res.StatusCode != 404 {
+		return fmt.Errorf("DELETE of blob %s returned %s", digest, res.Status)
+	}
+	return nil
+}
+
+func (s *S3Blobstore) URL(digest string, ttl time.Duration) (string, error) {
+	if !s.Presign {
+		return "", nil
+	}
+
+	u, err := s.url(digest)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", s.AccessKey+"/"+s.scope(now))
+	q.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	q.Set("X-Amz-Expires", fmt.Sprintf("%d", int(ttl.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+	u.RawQuery = q.Encode()
+
+	creq := strings.Join([]string{
+		"GET",
+		u.EscapedPath(),
+		u.RawQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	u.RawQuery += "&X-Amz-Signature=" + s.signature(now, creq)
+	return u.String(), nil
+}
+
+// s3Blob is a seekable handle on an object in an S3 bucket.  Seeking
+// is free; the next Read issues a ranged GET from the new offset.
+type s3Blob struct {
+	store  *S3Blobstore
+	digest string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (b *s3Blob) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+
+	if b.body == nil {
+		res, err := b.store.request("GET", b.digest, nil, 0, fmt.Sprintf("bytes=%d-", b.offset))
+		if err != nil {
+			return 0, err
+		}
+		if res.StatusCode != 206 && !(res.StatusCode == 200 && b.offset == 0) {
+			res.Body.Close()
+			return 0, fmt.Errorf("GET of blob %s returned %s", b.digest, res.Status)
+		}
+		b.body = res.Body
+	}
+
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	return n, err
+}
+
+func (b *s3Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return b.offset, fmt.Errorf("cannot seek to negative offset %d", offset)
+	}
+
+	if offset != b.offset && b.body != nil {
+		b.body.Close()
+		b.body = nil
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *s3Blob) Close() error {
+	if b.body != nil {
+		return b.body.Close()
+	}
+	return nil
+}
+
+func (s *S3Blobstore) scope(t time.Time) string {
+	return fmt.Sprintf("%s/%s/s3/aws4_request", t.Format("20060102"), s.Region)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (s *S3Blobstore) signature(t time.Time, creq string) string {
+	tosign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		s.scope(t),
+		fmt.Sprintf("%x", sha256.Sum256([]byte(creq))),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return fmt.Sprintf("%x", hmacSHA256(key, tosign))
+}
+
+// sign adds an AWS SigV4 Authorization header to req.  We don't sign
+// the payload itself, since that would mean reading it twice.
+func (s *S3Blobstore) sign(req *http.Request, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": "UNSIGNED-PAYLOAD",
+		"x-amz-date":           t.Format("20060102T150405Z"),
+	}
+	if rng := req.Header.Get("Range"); rng != "" {
+		headers["range"] = rng
+	}
+
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonical := ""
+	for _, k := range names {
+		canonical += k + ":" + headers[k] + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	creq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonical,
+		signed,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, s.scope(t), signed, s.signature(t, creq)))
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-db"
+)
+
+const BundleFormat = 1
+
+// A Bundle is a self-contained, offline copy of some set of release
+// and stemcell versions: the index metadata for each, plus the actual
+// tarballs.  On disk, it is a gzipped tar archive with the manifest
+// (as JSON) in bundle.json, followed by the tarballs in blobs/,
+// named for their SHA256 digests.
+type Bundle struct {
+	Format    int              `json:"format"`
+	Created   time.Time        `json:"created"`
+	Index     string           `json:"index"`
+	Artifacts []BundleArtifact `json:"artifacts"`
+}
+
+type BundleArtifact struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Template string `json:"template"`
+	Version  string `json:"version"`
+	SHA1     string `json:"sha1"`
+	SHA256   string `json:"sha256"`
+	URL      string `json:"url"`
+
+	file string /* local copy, during export */
+}
+
+func (a BundleArtifact) Blob() string {
+	return "blobs/" + a.SHA256
+}
+
+type specs []string
+
+func (l *specs) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *specs) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func BundleCommand(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "export":
+			return bundleExport(args[1:])
+		case "import":
+			return bundleImport(args[1:])
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "USAGE: genesis-index bundle export [--index URL] [--release NAME@VERSION ...] [--stemcell NAME@VERSION ...] -o FILE\n")
+	fmt.Fprintf(os.Stderr, "       genesis-index bundle import FILE\n")
+	return 1
+}
+
+func bundleExport(args []string) int {
+	var releases, stemcells specs
+
+	index := os.Getenv("GENESIS_INDEX")
+	if index == "" {
+		index = "https://genesis.starkandwayne.com"
+	}
+
+	fs := flag.NewFlagSet("bundle export", flag.ContinueOnError)
+	fs.StringVar(&index, "index", index, "Base URL of the Genesis Index to export from")
+	fs.Var(&releases, "release", "A release to export, as NAME@VERSION (or NAME@latest)")
+	fs.Var(&stemcells, "stemcell", "A stemcell to export, as NAME@VERSION (or NAME@latest)")
+	output := fs.String("o", "", "Path to write the bundle to")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *output == "" || len(releases)+len(stemcells) == 0 {
+		fmt.Fprintf(os.Stderr, "You must specify an output file (-o) and at least one --release or --stemcell\n")
+		return 1
+	}
+
+	b := Bundle{
+		Format:  BundleFormat,
+		Created: time.Now().UTC(),
+		Index:   strings.TrimSuffix(index, "/"),
+	}
+
+	defer func() {
+		for _, a := range b.Artifacts {
+			if a.file != "" {
+				os.Remove(a.file)
+			}
+		}
+	}()
+
+	for _, l := range []struct {
+		kind  string
+		specs specs
+	}{{"release", releases}, {"stemcell", stemcells}} {
+		for _, spec := range l.specs {
+			a, err := b.fetch(l.kind, spec)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s %s: %s\n", l.kind, spec, err)
+				return 2
+			}
+			fmt.Fprintf(os.Stderr, "%s %s/%s verified (sha1 %s)\n", a.Kind, a.Name, a.Version, a.SHA1)
+			b.Artifacts = append(b.Artifacts, a)
+		}
+	}
+
+	if err := b.write(*output); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write bundle to %s: %s\n", *output, err)
+		os.Remove(*output)
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "wrote %d artifacts to %s\n", len(b.Artifacts), *output)
+	return 0
+}
+
+func (b *Bundle) get(path string, out interface{}) error {
+	res, err := http.Get(b.Index + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned %s", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// fetch looks up the given NAME@VERSION in the index, downloads its
+// tarball, and verifies it against the checksums that the index has.
+func (b *Bundle) fetch(kind, spec string) (BundleArtifact, error) {
+	var a BundleArtifact
+
+	name, version := spec, "latest"
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		name, version = spec[:i], spec[i+1:]
+	}
+
+	var meta, v struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+		SHA1    string `json:"sha1"`
+		SHA256  string `json:"sha256"`
+		URL     string `json:"url"`
+	}
+	if err := b.get(fmt.Sprintf("/v1/%s/%s/metadata", kind, name), &meta); err != nil {
+		return a, err
+	}
+
+	path := fmt.Sprintf("/v1/%s/%s/v/%s", kind, name, version)
+	if version == "latest" {
+		path = fmt.Sprintf("/v1/%s/%s/latest", kind, name)
+	}
+	if err := b.get(path, &v); err != nil {
+		return a, err
+	}
+	if v.SHA1 == "" {
+		return a, fmt.Errorf("the index has no checksum for version %s", v.Version)
+	}
+
+	tmp, err := ioutil.TempFile("", "genesis-bundle")
+	if err != nil {
+		return a, err
+	}
+	a.file = tmp.Name()
+	defer tmp.Close()
+
+	dl, err := fetch(fmt.Sprintf("%s/v1/%s/%s/v/%s.tgz", b.Index, kind, name, v.Version), tmp)
+	if err != nil {
+		os.Remove(a.file)
+		return a, err
+	}
+	if dl.sha1 != v.SHA1 {
+		os.Remove(a.file)
+		return a, fmt.Errorf("downloaded tarball has sha1 %s, but the index says it should be %s", dl.sha1, v.SHA1)
+	}
+	if v.SHA256 != "" && dl.sha256 != v.SHA256 {
+		os.Remove(a.file)
+		return a, fmt.Errorf("downloaded tarball has sha256 %s, but the index says it should be %s", dl.sha256, v.SHA256)
+	}
+
+	a.Kind = kind
+	a.Name = v.Name
+	a.Template = meta.URL
+	a.Version = v.Version
+	a.SHA1 = dl.sha1
+	a.SHA256 = dl.sha256
+	a.URL = v.URL
+	return a, nil
+}
+
+func (b *Bundle) write(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	z := gzip.NewWriter(f)
+	t := tar.NewWriter(z)
+
+	manifest, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = t.WriteHeader(&tar.Header{
+		Name:    "bundle.json",
+		Mode:    0644,
+		Size:    int64(len(manifest)),
+		ModTime: b.Created,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = t.Write(manifest); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, a := range b.Artifacts {
+		if seen[a.SHA256] {
+			continue
+		}
+		seen[a.SHA256] = true
+
+		if err = addFile(t, a.Blob(), a.file); err != nil {
+			return err
+		}
+	}
+
+	if err = t.Close(); err != nil {
+		return err
+	}
+	if err = z.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func addFile(t *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = t.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    st.Size(),
+		ModTime: st.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(t, f)
+	return err
+}
+
+func bundleImport(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "USAGE: genesis-index bundle import FILE\n")
+		return 1
+	}
+
+	d := connect()
+	if d == nil {
+		return 2
+	}
+	if !configureBlobstore() {
+		return 2
+	}
+	if blobs == nil {
+		fmt.Fprintf(os.Stderr, "No blobstore is configured (see BLOBSTORE / BLOBSTORE_DIR); nowhere to put the tarballs\n")
+		return 2
+	}
+
+	n, err := importBundle(d, args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to import bundle %s: %s\n", args[0], err)
+		return 2
+	}
+	fmt.Fprintf(os.Stderr, "imported %d artifacts from %s\n", n, args[0])
+	return 0
+}
+
+// importBundle loads every artifact in the bundle at path into the
+// database and blobstore, verifying each tarball as it goes.
+func importBundle(d *db.DB, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	t := tar.NewReader(z)
+
+	h, err := t.Next()
+	if err != nil {
+		return 0, err
+	}
+	if h.Name != "bundle.json" {
+		return 0, fmt.Errorf("not a genesis-index bundle (found %s where bundle.json was expected)", h.Name)
+	}
+
+	var b Bundle
+	if err = json.NewDecoder(t).Decode(&b); err != nil {
+		return 0, err
+	}
+	if b.Format != BundleFormat {
+		return 0, fmt.Errorf("unsupported bundle format %d", b.Format)
+	}
+
+	have := make(map[string]bool)
+	for {
+		h, err = t.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		var wanted *BundleArtifact
+		for i := range b.Artifacts {
+			if b.Artifacts[i].Blob() == h.Name {
+				wanted = &b.Artifacts[i]
+				break
+			}
+		}
+		if wanted == nil {
+			return 0, fmt.Errorf("unexpected file %s found in bundle", h.Name)
+		}
+
+		if err = importBlob(t, h.Size, *wanted); err != nil {
+			return 0, fmt.Errorf("%s: %s", h.Name, err)
+		}
+		have[h.Name] = true
+	}
+	for _, a := range b.Artifacts {
+		if !have[a.Blob()] {
+			return 0, fmt.Errorf("bundle is missing the tarball for %s %s/%s", a.Kind, a.Name, a.Version)
+		}
+	}
+
+	for _, a := range b.Artifacts {
+		if n, err := d.Count(fmt.Sprintf(`SELECT * FROM %ss WHERE name = $1`, a.Kind), a.Name); err != nil {
+			return 0, err
+		} else if n == 0 {
+			switch a.Kind {
+			case "release":
+				err = CreateRelease(d, a.Name, a.Template, true)
+			case "stemcell":
+				err = CreateStemcell(d, a.Name, a.Template, true)
+			default:
+				err = fmt.Errorf("unrecognized artifact kind '%s'", a.Kind)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if err = register(d, a.Kind, a.Name, a.Version, a.SHA1, a.SHA256, a.URL); err != nil {
+			return 0, err
+		}
+		fmt.Fprintf(os.Stderr, "%s %s/%s imported\n", a.Kind, a.Name, a.Version)
+	}
+
+	return len(b.Artifacts), nil
+}
+
+func importBlob(r io.Reader, size int64, a BundleArtifact) error {
+	tmp, err := ioutil.TempFile("", "genesis-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sha1, sha256, err := checksums(io.TeeReader(r, tmp))
+	if err != nil {
+		return err
+	}
+	if sha1 != a.SHA1 || sha256 != a.SHA256 {
+		return fmt.Errorf("checksum mismatch (got sha1 %s / sha256 %s)", sha1, sha256)
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return blobs.Put(sha256, tmp, size)
+}
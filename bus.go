@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/lib/pq"
+	"github.com/starkandwayne/goutils/log"
+)
+
+const BusChannel = "genesis_index"
+
+// An Event announces that something about a tracked artifact has
+// changed.  Subscribers (i.e. the read cache) use it to throw away
+// whatever they know about that artifact.
+//
+// An Event with a Kind of "*" means that changes may have been
+// missed altogether (because the bus lost its connection, or the
+// subscriber fell behind), and everything should be considered stale.
+type Event struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// A Bus carries change Events between all of the running instances
+// of genesis-index that share a database.
+type Bus interface {
+	Publish(Event) error
+	Subscribe() <-chan Event
+}
+
+var bus Bus = NewLocalBus()
+
+// LocalBus is a single-process Bus, used when we are backed by
+// SQLite (and therefore can't be running more than one instance).
+//
+// Publishing never blocks.  If a subscriber's buffer is full, the
+// event is dropped, along with any others until it catches up, at
+// which point it gets a single "*" event to make up for all of them.
+type LocalBus struct {
+	lock sync.Mutex
+	subs []*subscriber
+}
+
+type subscriber struct {
+	ch     chan Event
+	behind bool
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+func (b *LocalBus) Subscribe() <-chan Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	s := &subscriber{ch: make(chan Event, 64)}
+	b.subs = append(b.subs, s)
+	return s.ch
+}
+
+func (b *LocalBus) Publish(e Event) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, s := range b.subs {
+		if s.behind {
+			continue /* the "*" that catches it up covers this too */
+		}
+		select {
+		case s.ch <- e:
+		default:
+			log.Warnf("subscriber is not keeping up; dropping %s '%s' event (and any more until it catches up)", e.Kind, e.Name)
+			s.behind = true
+			go b.catchUp(s)
+		}
+	}
+	return nil
+}
+
+// catchUp waits for a subscriber that fell behind to make room for a
+// "*" event.  The send happens with the lock held, so that no event
+// can slip past between the "*" going out and the subscriber being
+// considered caught up.
+func (b *LocalBus) catchUp(s *subscriber) {
+	for {
+		b.lock.Lock()
+		select {
+		case s.ch <- Event{Kind: "*"}:
+			s.behind = false
+			b.lock.Unlock()
+			log.Infof("subscriber has caught up; invalidating everything")
+			return
+		default:
+		}
+		b.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// PostgresBus publishes Events via NOTIFY on BusChannel, and LISTENs
+// on that same channel to fan them back out to local subscribers.
+// Every instance (including the publisher) sees every Event.
+type PostgresBus struct {
+	local    *LocalBus
+	db       *db.DB
+	listener *pq.Listener
+}
+
+func NewPostgresBus(d *db.DB, dsn string) (*PostgresBus, error) {
+	b := &PostgresBus{
+		local: NewLocalBus(),
+		db:    d,
+	}
+
+	b.listener = pq.NewListener(dsn, 1*time.Second, 1*time.Minute,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Errorf("change notification listener: %s", err)
+			}
+		})
+	if err := b.listener.Listen(BusChannel); err != nil {
+		b.listener.Close()
+		return nil, err
+	}
+
+	go b.dispatch()
+	return b, nil
+}
+
+func (b *PostgresBus) Subscribe() <-chan Event {
+	return b.local.Subscribe()
+}
+
+func (b *PostgresBus) Publish(e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return b.db.Exec(`SELECT pg_notify($1, $2)`, BusChannel, string(payload))
+}
+
+func (b *PostgresBus) dispatch() {
+	for n := range b.listener.NotificationChannel() {
+		if n == nil {
+			/* the listener reconnected; anything could have
+			   happened while we weren't looking. */
+			log.Infof("change notification listener reconnected; invalidating everything")
+			b.local.Publish(Event{Kind: "*"})
+			continue
+		}
+
+		var e Event
+		if err := json.Unmarshal([]byte(n.Extra), &e); err != nil {
+			log.Errorf("ignoring malformed change notification '%s': %s", n.Extra, err)
+			continue
+		}
+		b.local.Publish(e)
+	}
+}
+
+// invalidator keeps the read cache in sync with changes made by
+// other instances of genesis-index.
+func invalidator(events <-chan Event) {
+	for e := range events {
+		if e.Kind == "*" {
+			cache.Clear()
+			continue
+		}
+		cache.Invalidate(e.Kind, e.Name)
+	}
+}
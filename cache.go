@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Cache is a small, in-process read cache that sits in front of the
+// Find* functions.  Entries are tagged with the kind and name of the
+// artifact they were computed from (name is empty for collection-wide
+// lookups like "latest versions of all releases"), so that the write
+// paths can invalidate exactly what they changed; see touch().
+//
+// Every kind / name also has a generation, which is bumped whenever it
+// is invalidated.  Values are computed outside of the lock, so Fetch
+// only caches one if the generation hasn't moved on while it was being
+// computed; otherwise, a lookup that raced with a write could put the
+// stale value right back after the write invalidated it.
+type Cache struct {
+	lock    sync.Mutex
+	max     int
+	ttl     time.Duration
+	entries map[string]cacheEntry
+	gens    map[string]uint64
+	epoch   uint64
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	kind    string
+	name    string
+	value   interface{}
+	expires time.Time
+}
+
+type CacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+	Max     int    `json:"max"`
+	TTL     string `json:"ttl"`
+}
+
+var cache = NewCache(1000, 5*time.Minute)
+
+func NewCache(max int, ttl time.Duration) *Cache {
+	return &Cache{
+		max:     max,
+		ttl:     ttl,
+		entries: make(map[string]cacheEntry),
+		gens:    make(map[string]uint64),
+	}
+}
+
+func (c *Cache) Configure(max int, ttl time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.max = max
+	c.ttl = ttl
+	c.entries = make(map[string]cacheEntry)
+	c.epoch++
+}
+
+// generation returns the current generation of a kind / name (or, with
+// an empty name, of the collection-wide entries of a kind).  The caller
+// must hold the lock.
+func (c *Cache) generation(kind, name string) uint64 {
+	return c.epoch + c.gens[kind+"\x00"+name]
+}
+
+// Fetch returns the cached value for the given key, calling fn to
+// compute (and cache) it if it isn't there or has expired.  Errors
+// from fn are passed back to the caller, and never cached.
+func (c *Cache) Fetch(kind, name, key string, fn func() (interface{}, error)) (interface{}, error) {
+	id := kind + "\x00" + name + "\x00" + key
+
+	c.lock.Lock()
+	if e, ok := c.entries[id]; ok && time.Now().Before(e.expires) {
+		c.hits++
+		c.lock.Unlock()
+		return e.value, nil
+	}
+	c.misses++
+	gen := c.generation(kind, name)
+	c.lock.Unlock()
+
+	v, err := fn()
+	if err != nil {
+		return v, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.max <= 0 || c.ttl <= 0 || c.generation(kind, name) != gen {
+		return v, nil
+	}
+	if _, ok := c.entries[id]; !ok && len(c.entries) >= c.max {
+		c.evict()
+	}
+	c.entries[id] = cacheEntry{
+		kind:    kind,
+		name:    name,
+		value:   v,
+		expires: time.Now().Add(c.ttl),
+	}
+	return v, nil
+}
+
+// Invalidate drops everything cached for the named artifact, as well
+// as every collection-wide entry of the same kind.
+func (c *Cache) Invalidate(kind, name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.gens[kind+"\x00"+name]++
+	if name != "" {
+		c.gens[kind+"\x00"]++
+	}
+	for id, e := range c.entries {
+		if e.kind == kind && (e.name == "" || e.name == name) {
+			delete(c.entries, id)
+		}
+	}
+}
+
+// Clear drops everything in the cache.
+func (c *Cache) Clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = make(map[string]cacheEntry)
+	c.epoch++
+}
+
+func (c *Cache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: len(c.entries),
+		Max:     c.max,
+		TTL:     c.ttl.String(),
+	}
+}
+
+// evict drops expired entries or, failing that, whichever entry is
+// closest to expiring.  The caller must hold the lock.
+func (c *Cache) evict() {
+	now := time.Now()
+	victim := ""
+	var soonest time.Time
+	for id, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, id)
+			continue
+		}
+		if victim == "" || e.expires.Before(soonest) {
+			victim, soonest = id, e.expires
+		}
+	}
+	if len(c.entries) >= c.max && victim != "" {
+		delete(c.entries, victim)
+	}
+}
+
+type CacheAPI struct{}
+
+func (api CacheAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case match(r, `GET /v1/cache`):
+		respond(w, nil, 200, cache.Stats())
+		return
+	}
+
+	w.WriteHeader(404)
+}
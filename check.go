@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+// A VersionCheck carries the (optional) details that can be given when
+// asking for a version to be checked.  If URL is set, the version is
+// downloaded from there, instead of from the URL templates.  If SHA1 or
+// SHA256 are set, the download has to match them.  If Trusted is set
+// (and trusted registration is allowed; see trustable), the version is
+// registered straight away, on the strength of its checksums, and then
+// checked in the background like any other.  If the download turns out
+// not to match, the version is dropped again.  Versions that are already
+// known can't be registered this way.
+type VersionCheck struct {
+	Notes   string `json:"notes"`
+	URL     string `json:"url"`
+	SHA1    string `json:"sha1"`
+	SHA256  string `json:"sha256"`
+	Trusted bool   `json:"trusted"`
+
+	RequestID string `json:"-"`
+
+	ticket  int64
+	resumed bool
+}
+
+func (c VersionCheck) validate() error {
+	if c.SHA1 != "" && !regexp.MustCompile(`^[0-9a-f]{40}$`).MatchString(c.SHA1) {
+		return fmt.Errorf("invalid sha1 '%s'", c.SHA1)
+	}
+	if c.SHA256 != "" && !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(c.SHA256) {
+		return fmt.Errorf("invalid sha256 '%s'", c.SHA256)
+	}
+	if c.Trusted && c.SHA1 == "" {
+		return fmt.Errorf("registering a version before checking it requires (at least) its sha1")
+	}
+	return nil
+}
+
+// trustable checks that versions of a release or stemcell may be registered
+// before they have been checked.  That has to be switched on explicitly,
+// with ALLOW_TRUSTED_REGISTRATION=yes, and is never allowed for anything
+// with upstream signature verification set up, since the signature isn't
+// looked at until the (later) check.
+func trustable(d *db.DB, kind, name string) error {
+	if os.Getenv("ALLOW_TRUSTED_REGISTRATION") != "yes" {
+		return fmt.Errorf("registering versions before checking them is not allowed on this index")
+	}
+
+	r, err := d.Query(fmt.Sprintf(`SELECT sig_url, sig_keys FROM %ss WHERE name = $1`, kind), name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if !r.Next() {
+		return fmt.Errorf("%s '%s' not found", kind, name)
+	}
+	var sigurl, keys string
+	if err = r.Scan(&sigurl, &keys); err != nil {
+		return err
+	}
+	if sigurl != "" || len(trustedKeys(keys)) > 0 {
+		return fmt.Errorf("%s '%s' has upstream signature verification set up, so its versions cannot be registered before they are checked", kind, name)
+	}
+	return nil
+}
+
+// known returns true if a version of a release or stemcell is already in
+// the index (or on its way in).  Trusted registration never replaces a
+// known version, since that would swap checksums that were checked for
+// ones that haven't been (yet).
+func known(d *db.DB, kind, name, version string) (bool, error) {
+	n, err := d.Count(fmt.Sprintf(`SELECT * FROM %s_versions WHERE name = $1 AND version = $2`, kind), name, version)
+	return n > 0, err
+}
+
+// expect checks a download against the expected digests, if any.
+func (c VersionCheck) expect(sha1, sha256 string) error {
+	if c.SHA1 != "" && c.SHA1 != sha1 {
+		return fmt.Errorf("sha1 mismatch: expected %s, but the download has %s", c.SHA1, sha1)
+	}
+	if c.SHA256 != "" && c.SHA256 != sha256 {
+		return fmt.Errorf("sha256 mismatch: expected %s, but the download has %s", c.SHA256, sha256)
+	}
+	return nil
+}
+
+// The backlog is every version check that has been asked for, but hasn't
+// finished yet (either because it is still running, or because it is
+// waiting on a re-check of an earlier version).  It is kept around so
+// that, when shutting down, whatever is left can be checkpointed, and
+// picked up again on the next start.
+
+type queuedCheck struct {
+	kind    string
+	name    string
+	version string
+	check   VersionCheck
+}
+
+var backlog = struct {
+	sync.Mutex
+	next     int64
+	checks   map[int64]queuedCheck
+	draining bool
+}{checks: make(map[int64]queuedCheck)}
+
+// enqueue adds a version check to the backlog, returning its ticket.
+func enqueue(kind, name, version string, c VersionCheck) int64 {
+	backlog.Lock()
+	defer backlog.Unlock()
+
+	backlog.next++
+	backlog.checks[backlog.next] = queuedCheck{kind: kind, name: name, version: version, check: c}
+	return backlog.next
+}
+
+// finish takes a version check off of the backlog.
+func finish(ticket int64) {
+	backlog.Lock()
+	delete(backlog.checks, ticket)
+	backlog.Unlock()
+}
+
+func Backlog() int64 {
+	backlog.Lock()
+	defer backlog.Unlock()
+	return int64(len(backlog.checks))
+}
+
+// draining is true once shutdown has started; queued re-checks that
+// haven't started yet are shelved for the next start.
+func draining() bool {
+	backlog.Lock()
+	defer backlog.Unlock()
+	return backlog.draining
+}
+
+// shelve checkpoints a queued version check that isn't going to be
+// started before shutdown, and takes it off the backlog, so that
+// DrainChecks doesn't wait on it.
+func shelve(d *db.DB, kind, name, version string, c VersionCheck) {
+	checkpoint(d, kind, name, version, c)
+	finish(c.ticket)
+}
+
+// DrainChecks waits (until the deadline) for the backlog of version checks
+// to finish, and then checkpoints whatever is left as pending, so that
+// ResumeChecks can pick it up on the next start.  It returns how many
+// checks were left; those may well still be running (and using the
+// database) until the process exits.
+func DrainChecks(d *db.DB, deadline time.Time) int {
+	backlog.Lock()
+	backlog.draining = true
+	backlog.Unlock()
+
+	for Backlog() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	backlog.Lock()
+	left := make([]queuedCheck, 0, len(backlog.checks))
+	for _, q := range backlog.checks {
+		left = append(left, q)
+	}
+	backlog.Unlock()
+
+	if len(left) > 0 {
+		log.Infof("checkpointing %d unfinished version check(s), to resume on restart", len(left))
+	}
+	for _, q := range left {
+		checkpoint(d, q.kind, q.name, q.version, q.check)
+	}
+	return len(left)
+}
+
+// A savedCheck is a version check, as stored in the database so that it
+// can be resumed.
+type savedCheck struct {
+	VersionCheck
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// checkpoint marks a version check as pending, and saves what it was
+// asked to do, so that it can be resumed if the index stops before it
+// finishes.
+func checkpoint(d *db.DB, kind, name, version string, c VersionCheck) {
+	setCheckStatus(d, c.RequestID, kind, name, version, "pending", "")
+
+	b, err := json.Marshal(savedCheck{VersionCheck: c, RequestID: c.RequestID})
+	if err == nil {
+		err = d.Exec(`UPDATE checks SET request = $1 WHERE kind = $2 AND name = $3 AND version = $4`,
+			string(b), kind, name, version)
+	}
+	if err != nil {
+		log.Errorf("unable to checkpoint check of version '%s' of %s '%s': %s", version, kind, name, err)
+	}
+}
+
+// ResumeChecks starts over any version checks that were still pending
+// when the index last stopped.
+func ResumeChecks(d *db.DB) {
+	r, err := d.Query(`SELECT kind, name, version, request FROM checks WHERE status = 'pending'`)
+	if err != nil {
+		log.Errorf("unable to find pending version checks: %s", err)
+		return
+	}
+
+	var l []queuedCheck
+	for r.Next() {
+		var q queuedCheck
+		var request string
+		if err = r.Scan(&q.kind, &q.name, &q.version, &request); err != nil {
+			log.Errorf("unable to find pending version checks: %s", err)
+			break
+		}
+		var saved savedCheck
+		if request != "" {
+			json.Unmarshal([]byte(request), &saved)
+		}
+		q.check = saved.VersionCheck
+		q.check.RequestID = saved.RequestID
+		q.check.resumed = true
+		l = append(l, q)
+	}
+	r.Close()
+
+	for _, q := range l {
+		log.Infof("resuming check of version '%s' of %s '%s'", q.version, q.kind, q.name)
+		if q.kind == "release" {
+			err = CheckReleaseVersion(d, q.name, q.version, q.check)
+		} else {
+			err = CheckStemcellVersion(d, q.name, q.version, q.check)
+		}
+		if err != nil {
+			setCheckStatus(d, q.check.RequestID, q.kind, q.name, q.version, "failed", err.Error())
+		}
+	}
+}
+
+// A CheckStatus is the outcome of the most recent check of a version:
+// `pending` while it is still running, and then `ok` or `failed` (with
+// the reason why).  Failed checks of new versions forget the version,
+// but not its CheckStatus.
+type CheckStatus struct {
+	Status  string    `json:"status"`
+	Reason  string    `json:"reason,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// setCheckStatus records (and logs) the status of a version check, on
+// behalf of the request with the given ID.
+func setCheckStatus(d *db.DB, rid, kind, name, version, status, reason string) {
+	now := time.Now().Unix()
+	if status != "pending" {
+		checkOutcomes.Inc(kind, status)
+	}
+
+	level := "info"
+	if status == "failed" {
+		level = "error"
+	}
+	fields := map[string]interface{}{
+		"kind":    kind,
+		"name":    name,
+		"version": version,
+		"status":  status,
+	}
+	if reason != "" {
+		fields["reason"] = reason
+	}
+	logEvent(level, rid, "version check "+status, fields)
+
+	n, err := d.Count(`SELECT * FROM checks WHERE kind = $1 AND name = $2 AND version = $3`, kind, name, version)
+	if err == nil && n == 0 {
+		err = d.Exec(`INSERT INTO checks (kind, name, version, status, reason, updated) VALUES ($1, $2, $3, $4, $5, $6)`,
+			kind, name, version, status, reason, now)
+	} else if err == nil {
+		err = d.Exec(`
+UPDATE checks
+   SET status  = $1,
+       reason  = $2,
+       updated = $3
+
+ WHERE kind    = $4
+   AND name    = $5
+   AND version = $6`, status, reason, now, kind, name, version)
+	}
+	if err != nil {
+		log.Errorf("unable to record check status of version '%s' of %s '%s': %s", version, kind, name, err)
+	}
+}
+
+func FindCheckStatus(d *db.DB, kind, name, version string) (CheckStatus, error) {
+	var o CheckStatus
+
+	r, err := d.Query(`SELECT status, reason, updated FROM checks WHERE kind = $1 AND name = $2 AND version = $3`,
+		kind, name, version)
+	if err != nil {
+		return o, err
+	}
+	defer r.Close()
+
+	if !r.Next() {
+		return o, fmt.Errorf("version '%s' of %s '%s' has never been checked", version, kind, name)
+	}
+	var updated int64
+	if err = r.Scan(&o.Status, &o.Reason, &updated); err != nil {
+		return o, err
+	}
+	o.Updated = time.Unix(updated, 0).UTC()
+	return o, nil
+}
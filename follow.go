@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+// A Follower periodically pulls releases, stemcells and their versions
+// from one or more upstream genesis-index instances, and merges them
+// into the local database.  Rows that came from upstream are tagged
+// with the upstream's base URL (in their origin column); rows that
+// were created locally have an empty origin, and always win.
+//
+// Policy governs what happens when something we got from an upstream
+// disappears from it: "keep" it, "delete" it, or "disable" it (which
+// only applies to releases and stemcells, not individual versions).
+//
+// When several instances share a (PostgreSQL) database, only one of them
+// follows at a time: whichever holds the follower lock, a session-level
+// advisory lock, taken on a connection kept aside just for that.  If the
+// leader goes away, so does its connection (and the lock), and one of
+// the others takes over the next time it tries.  SQLite databases are
+// never shared, so there is nothing to lock.
+type Follower struct {
+	Upstreams []string
+	Interval  time.Duration
+	Policy    string
+
+	db     *db.DB
+	client *http.Client
+
+	locks   *sql.DB
+	lock    *sql.Conn
+	standby bool
+}
+
+// followerLock is the key of the PostgreSQL advisory lock held by
+// whichever instance is following upstream indexes.
+const followerLock = 0x67656e6573697300
+
+type upstreamVersion struct {
+	Version string   `json:"version"`
+	SHA1    string   `json:"sha1"`
+	SHA256  string   `json:"sha256"`
+	URL     string   `json:"url"`
+	URLs    []string `json:"urls"`
+	Yanked  *Yank    `json:"yanked"`
+}
+
+type localVersion struct {
+	origin string
+	sha1   string
+	sha256 string
+	url    string
+	urls   string
+	yanked *Yank
+}
+
+func NewFollower(d *db.DB, upstreams string, interval time.Duration, policy string) (*Follower, error) {
+	f := &Follower{
+		Interval: interval,
+		Policy:   policy,
+		db:       d,
+		client:   &http.Client{Timeout: 1 * time.Minute},
+	}
+
+	for _, u := range strings.FieldsFunc(upstreams, func(c rune) bool { return c == ',' || c == ' ' }) {
+		f.Upstreams = append(f.Upstreams, strings.TrimSuffix(u, "/"))
+	}
+	if len(f.Upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream indexes given")
+	}
+
+	switch f.Policy {
+	case "":
+		f.Policy = "keep"
+	case "keep", "delete", "disable":
+	default:
+		return nil, fmt.Errorf("unrecognized upstream removal policy '%s' (must be 'keep', 'delete' or 'disable')", policy)
+	}
+
+	if strings.HasSuffix(d.Driver, "postgres") {
+		locks, err := sql.Open(d.Driver, d.DSN)
+		if err != nil {
+			return nil, err
+		}
+		locks.SetMaxOpenConns(1)
+		f.locks = locks
+	}
+
+	return f, nil
+}
+
+func (f *Follower) Run() {
+	for {
+		if f.leading() {
+			for _, upstream := range f.Upstreams {
+				for _, kind := range []string{"release", "stemcell"} {
+					if err := f.sync(upstream, kind); err != nil {
+						log.Errorf("unable to sync %ss from %s: %s", kind, upstream, err)
+					}
+				}
+			}
+		}
+		time.Sleep(f.Interval)
+	}
+}
+
+// leading returns true if this instance should be the one syncing from
+// upstream, taking the follower lock if nobody else holds it, and
+// making sure the connection it was taken on (and so the lock) is
+// still there if we already do.
+func (f *Follower) leading() bool {
+	if f.locks == nil {
+		return true
+	}
+	ctx := context.Background()
+
+	if f.lock != nil {
+		_, err := f.lock.ExecContext(ctx, `SELECT 1`)
+		if err == nil {
+			return true
+		}
+		log.Errorf("lost the connection holding the follower lock: %s", err)
+		f.lock.Close()
+		f.lock = nil
+	}
+
+	conn, err := f.locks.Conn(ctx)
+	if err != nil {
+		log.Errorf("unable to take the follower lock: %s", err)
+		return false
+	}
+	var ok bool
+	if err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, int64(followerLock)).Scan(&ok); err != nil || !ok {
+		if err != nil {
+			log.Errorf("unable to take the follower lock: %s", err)
+		} else if !f.standby {
+			log.Infof("another instance is following upstream indexes; standing by")
+		}
+		f.standby = true
+		conn.Close()
+		return false
+	}
+
+	log.Infof("took the follower lock; following upstream indexes")
+	f.lock = conn
+	f.standby = false
+	return true
+}
+
+func (f *Follower) get(upstream, path string, out interface{}) error {
+	res, err := f.client.Get(upstream + path)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return fmt.Errorf("GET %s returned %s", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// owner returns the origin of the named artifact, and whether or not
+// it exists locally at all.
+func (f *Follower) owner(kind, name string) (string, bool, error) {
+	r, err := f.db.Query(fmt.Sprintf(`SELECT origin FROM %ss WHERE name = $1`, kind), name)
+	if err != nil {
+		return "", false, err
+	}
+	defer r.Close()
+
+	if !r.Next() {
+		return "", false, nil
+	}
+	var origin string
+	err = r.Scan(&origin)
+	return origin, true, err
+}
+
+func (f *Follower) sync(upstream, kind string) error {
+	log.Debugf("syncing %ss from %s", kind, upstream)
+
+	var names []string
+	if err := f.get(upstream, fmt.Sprintf("/v1/%s", kind), &names); err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		seen[name] = true
+
+		origin, exists, err := f.owner(kind, name)
+		if err != nil {
+			return err
+		}
+		if exists && origin != upstream {
+			/* local (or another upstream's) artifacts take precedence */
+			continue
+		}
+
+		if err = f.syncArtifact(upstream, kind, name, exists); err != nil {
+			log.Errorf("unable to sync %s '%s' from %s: %s", kind, name, upstream, err)
+		}
+	}
+
+	/* deal with things that have gone away upstream */
+	r, err := f.db.Query(fmt.Sprintf(`SELECT name FROM %ss WHERE origin = $1`, kind), upstream)
+	if err != nil {
+		return err
+	}
+	var gone []string
+	for r.Next() {
+		var name string
+		if err = r.Scan(&name); err != nil {
+			r.Close()
+			return err
+		}
+		if !seen[name] {
+			gone = append(gone, name)
+		}
+	}
+	r.Close()
+
+	for _, name := range gone {
+		log.Infof("%s '%s' has been removed from %s; applying '%s' policy", kind, name, upstream, f.Policy)
+		if err = f.remove(kind, name, ""); err != nil {
+			log.Errorf("unable to remove %s '%s': %s", kind, name, err)
+		}
+	}
+	return nil
+}
+
+func (f *Follower) syncArtifact(upstream, kind, name string, exists bool) error {
+	var meta struct {
+		URL  string   `json:"url"`
+		URLs []string `json:"urls"`
+	}
+	if err := f.get(upstream, fmt.Sprintf("/v1/%s/%s/metadata", kind, name), &meta); err != nil {
+		return err
+	}
+	fallbacks := "[]"
+	if len(meta.URLs) > 1 && meta.URLs[0] == meta.URL {
+		fallbacks = jsonList(meta.URLs[1:])
+	}
+
+	var versions []upstreamVersion
+	if err := f.get(upstream, fmt.Sprintf("/v1/%s/%s", kind, name), &versions); err != nil {
+		return err
+	}
+
+	changed := false
+	if !exists {
+		err := f.db.Exec(fmt.Sprintf(`INSERT INTO %ss (name, url, origin, fallback_urls) VALUES ($1, $2, $3, $4)`, kind),
+			name, meta.URL, upstream, fallbacks)
+		if err != nil {
+			return err
+		}
+		changed = true
+	} else if n, err := f.db.Count(fmt.Sprintf(`SELECT * FROM %ss WHERE name = $1 AND (url <> $2 OR fallback_urls <> $3)`, kind),
+		name, meta.URL, fallbacks); err != nil {
+		return err
+	} else if n != 0 {
+		err = f.db.Exec(fmt.Sprintf(`UPDATE %ss SET url = $1, fallback_urls = $2 WHERE name = $3`, kind),
+			meta.URL, fallbacks, name)
+		if err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	have := make(map[string]localVersion)
+	r, err := f.db.Query(fmt.Sprintf(`
+SELECT version, origin, sha1, sha256, url, urls, yanked_at, yank_reason, yank_replacement
+  FROM %s_versions
+ WHERE name = $1`, kind), name)
+	if err != nil {
+		return err
+	}
+	for r.Next() {
+		var version string
+		var v localVersion
+		var yankedAt int64
+		var yankReason, yankReplacement string
+		if err = r.Scan(&version, &v.origin, &v.sha1, &v.sha256, &v.url, &v.urls, &yankedAt, &yankReason, &yankReplacement); err != nil {
+			r.Close()
+			return err
+		}
+		v.yanked = yanked(yankedAt, yankReason, yankReplacement)
+		have[version] = v
+	}
+	r.Close()
+
+	seen := make(map[string]bool)
+	for _, v := range versions {
+		seen[v.Version] = true
+
+		if local, ok := have[v.Version]; ok {
+			if local.origin == "" {
+				continue /* local versions take precedence */
+			}
+			if local.sha1 == v.SHA1 && local.sha256 == v.SHA256 && local.url == v.URL && local.urls == jsonList(v.URLs) &&
+				sameYank(local.yanked, v.Yanked) {
+				continue
+			}
+		}
+
+		if err = register(f.db, kind, name, v.Version, v.SHA1, v.SHA256, v.URL); err != nil {
+			return err
+		}
+		err = f.db.Exec(fmt.Sprintf(`UPDATE %s_versions SET origin = $3, urls = $4 WHERE name = $1 AND version = $2`, kind),
+			name, v.Version, upstream, jsonList(v.URLs))
+		if err != nil {
+			return err
+		}
+		if err = setYank(f.db, kind, name, v.Version, v.Yanked); err != nil {
+			return err
+		}
+		log.Debugf("synced version '%s' of %s '%s' from %s", v.Version, kind, name, upstream)
+	}
+
+	for version, local := range have {
+		if local.origin == upstream && !seen[version] {
+			log.Infof("version '%s' of %s '%s' has been removed from %s; applying '%s' policy",
+				version, kind, name, upstream, f.Policy)
+			if err = f.remove(kind, name, version); err != nil {
+				return err
+			}
+		}
+	}
+
+	if changed {
+		touch(f.db, kind, name)
+	}
+	return nil
+}
+
+// remove applies the removal policy to an artifact (or one of its
+// versions, if version is not empty) that has gone away upstream.
+func (f *Follower) remove(kind, name, version string) error {
+	switch f.Policy {
+	case "delete":
+		if version != "" {
+			if kind == "release" {
+				return DeleteReleaseVersion(f.db, name, version)
+			}
+			return DeleteStemcellVersion(f.db, name, version)
+		}
+		if kind == "release" {
+			return DeleteRelease(f.db, name)
+		}
+		return DeleteStemcell(f.db, name)
+
+	case "disable":
+		if version == "" {
+			n, err := f.db.Count(fmt.Sprintf(`SELECT * FROM %ss WHERE name = $1 AND disabled = $2`, kind), name, true)
+			if err != nil || n != 0 {
+				return err
+			}
+			err = f.db.Exec(fmt.Sprintf(`UPDATE %ss SET disabled = $2 WHERE name = $1`, kind), name, true)
+			if err != nil {
+				return err
+			}
+			touch(f.db, kind, name)
+			return nil
+		}
+		log.Infof("version '%s' of %s '%s' cannot be disabled; keeping it", version, kind, name)
+	}
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+// /healthz says whether the index is alive (i.e. it can still talk to its
+// database), and /readyz whether it is ready to serve traffic: the
+// database is reachable, its schema is up to date, and the backlog of
+// version checks is under control.  Both answer 503 if anything is
+// degraded, so that platform health checks can act on it.
+
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+	Version int    `json:"version,omitempty"`
+	Latest  int    `json:"latest,omitempty"`
+	Backlog *int64 `json:"backlog,omitempty"`
+	Limit   int64  `json:"limit,omitempty"`
+}
+
+// healthTimeout is how long the database has to answer a health check,
+// before it is considered unreachable.
+const healthTimeout = 5 * time.Second
+
+func (h *Health) add(name string, c HealthCheck, err error) {
+	c.Status = "ok"
+	if err != nil {
+		c.Status = "degraded"
+		c.Error = err.Error()
+		h.Status = "degraded"
+	}
+	h.Checks[name] = c
+}
+
+// A pingFlight is a database ping in progress.  If the database hangs,
+// every health check that comes along waits on the same one, rather
+// than leaving yet another goroutine stuck behind it.
+type pingFlight struct {
+	done chan struct{}
+	err  error
+}
+
+var pings = struct {
+	sync.Mutex
+	inflight map[*db.DB]*pingFlight
+}{inflight: make(map[*db.DB]*pingFlight)}
+
+func pingDatabase(d *db.DB) error {
+	pings.Lock()
+	f, ok := pings.inflight[d]
+	if !ok {
+		f = &pingFlight{done: make(chan struct{})}
+		pings.inflight[d] = f
+		go func() {
+			_, f.err = d.Count(`SELECT 1`)
+			pings.Lock()
+			delete(pings.inflight, d)
+			pings.Unlock()
+			close(f.done)
+		}()
+	}
+	pings.Unlock()
+
+	select {
+	case <-f.done:
+		return f.err
+	case <-time.After(healthTimeout):
+		return fmt.Errorf("database did not respond within %s", healthTimeout)
+	}
+}
+
+func checkSchema(d *db.DB) (HealthCheck, error) {
+	var c HealthCheck
+	if schema == nil {
+		return c, fmt.Errorf("database schema has not been set up")
+	}
+
+	v, err := schema.Current(d)
+	if err != nil {
+		return c, err
+	}
+	c.Version, c.Latest = v, schema.Latest()
+	if c.Version != c.Latest {
+		return c, fmt.Errorf("database schema is at v%d, not v%d", c.Version, c.Latest)
+	}
+	return c, nil
+}
+
+// backlogLimit is the most version checks that can be waiting before the
+// index no longer considers itself ready.  Zero means no limit.
+func backlogLimit() int64 {
+	if s := os.Getenv("CHECK_BACKLOG_LIMIT"); s != "" {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && n >= 0 {
+			return n
+		}
+		log.Errorf("Ignoring invalid CHECK_BACKLOG_LIMIT '%s'", s)
+	}
+	return 0
+}
+
+func checkBacklog() (HealthCheck, error) {
+	n := Backlog()
+	c := HealthCheck{Backlog: &n, Limit: backlogLimit()}
+	if c.Limit > 0 && n > c.Limit {
+		return c, fmt.Errorf("%d version checks are waiting (the limit is %d)", n, c.Limit)
+	}
+	return c, nil
+}
+
+func CheckHealth(d *db.DB, ready bool) Health {
+	h := Health{
+		Status: "ok",
+		Checks: make(map[string]HealthCheck),
+	}
+
+	err := pingDatabase(d)
+	h.add("database", HealthCheck{}, err)
+	if !ready {
+		return h
+	}
+
+	if err != nil {
+		h.add("schema", HealthCheck{}, fmt.Errorf("database is unreachable"))
+	} else {
+		c, err := checkSchema(d)
+		h.add("schema", c, err)
+	}
+
+	c, err := checkBacklog()
+	h.add("backlog", c, err)
+	return h
+}
+
+type HealthAPI struct {
+	db *db.DB
+}
+
+func (api HealthAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case match(r, `GET /healthz`), match(r, `GET /readyz`):
+		h := CheckHealth(api.db, r.URL.Path == "/readyz")
+		if h.Status != "ok" {
+			log.Errorf("%s: %s", r.URL.Path, h.Status)
+			respond(w, nil, 503, h)
+			return
+		}
+		respond(w, nil, 200, h)
+		return
+	}
+
+	w.WriteHeader(404)
+}
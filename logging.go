@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/starkandwayne/goutils/log"
+)
+
+// Every request gets a request ID, either from its X-Request-ID header
+// (so that IDs assigned by a load balancer or router carry through), or
+// a freshly generated one.  The ID is sent back in the response, written
+// to the access log line for the request, and passed along to anything
+// the request kicks off in the background (like version checks), so
+// that their log lines can be tied back to it.
+
+type requestKey struct{}
+
+// requestInfo is filled in as a request is handled, for logging it.
+type requestInfo struct {
+	id        string
+	route     string
+	principal string
+	err       string
+}
+
+func info(r *http.Request) *requestInfo {
+	if i, ok := r.Context().Value(requestKey{}).(*requestInfo); ok {
+		return i
+	}
+	return &requestInfo{}
+}
+
+// requestID returns the ID of a request, or "" if it doesn't have one.
+func requestID(r *http.Request) string {
+	return info(r).id
+}
+
+// routed records the route a request was handled by, i.e. the pattern
+// of the ServeHTTP case that matched it; match() calls it.
+func routed(r *http.Request, pattern string) {
+	if i := info(r); i.route == "" {
+		i.route = pattern
+	}
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// accessWriter keeps track of the status and size of a response, and of
+// any error bail() sent back in it.
+type accessWriter struct {
+	http.ResponseWriter
+	info   *requestInfo
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// failed notes an error that is being sent back in a response, so that
+// it ends up in the access log (instead of on a line of its own).  It
+// returns false if the response isn't being logged.
+func failed(w http.ResponseWriter, e error) bool {
+	if aw, ok := w.(*accessWriter); ok {
+		aw.info.err = e.Error()
+		return true
+	}
+	return false
+}
+
+// Structured log lines are written to standard output, one JSON object
+// per line, alongside (but never interleaved with) the regular logs.
+var structured sync.Mutex
+
+func logJSON(fields map[string]interface{}) {
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	b, err := json.Marshal(fields)
+	if err != nil {
+		log.Errorf("unable to write structured log line: %s", err)
+		return
+	}
+
+	structured.Lock()
+	defer structured.Unlock()
+	os.Stdout.Write(append(b, '\n'))
+}
+
+// logEvent writes a structured application log line, tagged with the
+// ID of the request that led to it (if any).
+func logEvent(level, rid, msg string, fields map[string]interface{}) {
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	fields["level"] = level
+	fields["msg"] = msg
+	if rid != "" {
+		fields["request_id"] = rid
+	}
+	logJSON(fields)
+}
+
+// instrument wraps the API, to give every request an ID, and to count,
+// time and log them.
+func instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		i := &requestInfo{id: r.Header.Get("X-Request-ID")}
+		if !validRequestID.MatchString(i.id) {
+			i.id = newRequestID()
+		}
+		r = r.WithContext(context.WithValue(r.Context(), requestKey{}, i))
+		w.Header().Set("X-Request-ID", i.id)
+		aw := &accessWriter{ResponseWriter: w, info: i}
+
+		h.ServeHTTP(aw, r)
+
+		if i.route == "" {
+			i.route = "unmatched"
+		}
+		if aw.status == 0 {
+			aw.status = 200
+		}
+		httpRequests.Inc(i.route, r.Method, fmt.Sprintf("%d", aw.status))
+		httpDuration.Since(start, i.route)
+
+		line := map[string]interface{}{
+			"level":       "info",
+			"msg":         "access",
+			"request_id":  i.id,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"route":       i.route,
+			"status":      aw.status,
+			"bytes":       aw.bytes,
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"remote":      r.RemoteAddr,
+		}
+		if i.principal != "" {
+			line["principal"] = i.principal
+		}
+		if i.err != "" {
+			line["level"] = "error"
+			line["error"] = i.err
+		}
+		logJSON(line)
+	})
+}
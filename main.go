@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jhunt/go-db"
 	"github.com/starkandwayne/goutils/log"
@@ -21,20 +27,205 @@ func main() {
 		Type:  "console",
 		Level: level,
 	})
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bundle":
+			os.Exit(BundleCommand(os.Args[2:]))
+		case "export":
+			os.Exit(ExportCommand(os.Args[2:]))
+		case "import":
+			os.Exit(ImportCommand(os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "Unrecognized command '%s'\n", os.Args[1])
+			fmt.Fprintf(os.Stderr, "USAGE: %s [(export|import|bundle) ...]\n", os.Args[0])
+			os.Exit(1)
+		}
+	}
+
 	log.Infof("genesis-index starting up")
+	d := connect()
+	if d == nil {
+		return
+	}
+
+	/* clean house */
+	d.Exec(`DELETE FROM release_versions WHERE valid = 0`)
+	d.Exec(`DELETE FROM stemcell_versions WHERE valid = 0`)
+
+	/* configure the read cache */
+	size, ttl := 1000, 5*time.Minute
+	if s := os.Getenv("CACHE_SIZE"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil {
+			size = n
+		} else {
+			log.Errorf("Ignoring invalid CACHE_SIZE '%s': %s", s, err)
+		}
+	}
+	if s := os.Getenv("CACHE_TTL"); s != "" {
+		if t, err := time.ParseDuration(s); err == nil {
+			ttl = t
+		} else {
+			log.Errorf("Ignoring invalid CACHE_TTL '%s': %s", s, err)
+		}
+	}
+	cache.Configure(size, ttl)
+	go invalidator(bus.Subscribe())
+
+	if !configureBlobstore() {
+		return
+	}
+
+	/* set up response signing */
+	if key := os.Getenv("SIGNING_KEY"); key == "" {
+		log.Warnf("No SIGNING_KEY set; version records will not be signed")
+	} else {
+		sgn, err := NewSigner(key)
+		if err != nil {
+			log.Errorf("Unable to set up response signing: %s", err)
+			return
+		}
+		signer = sgn
+		log.Infof("signing version records with key %s", signer.ID)
+	}
+
+	/* follow upstream indexes, if so configured */
+	if upstreams := os.Getenv("UPSTREAM_INDEXES"); upstreams != "" {
+		interval := 1 * time.Hour
+		if s := os.Getenv("FOLLOW_INTERVAL"); s != "" {
+			if t, err := time.ParseDuration(s); err == nil {
+				interval = t
+			} else {
+				log.Errorf("Ignoring invalid FOLLOW_INTERVAL '%s': %s", s, err)
+			}
+		}
+		f, err := NewFollower(d, upstreams, interval, os.Getenv("UPSTREAM_REMOVALS"))
+		if err != nil {
+			log.Errorf("Unable to follow upstream indexes: %s", err)
+			return
+		}
+		log.Infof("following %s every %s", strings.Join(f.Upstreams, ", "), interval)
+		go f.Run()
+	}
+
+	/* pick up where the last run left off */
+	ResumeChecks(d)
+
+	/* count tarball downloads, writing them out every so often */
+	flush := 1 * time.Minute
+	if s := os.Getenv("DOWNLOAD_FLUSH_INTERVAL"); s != "" {
+		if t, err := time.ParseDuration(s); err == nil && t > 0 {
+			flush = t
+		} else {
+			log.Errorf("Ignoring invalid DOWNLOAD_FLUSH_INTERVAL '%s'", s)
+		}
+	}
+	go downloads.Run(d, flush)
+
+	/* set up the server */
+	mux := http.NewServeMux()
+	mux.Handle("/v1/release", ReleaseAPI{db: d})
+	mux.Handle("/v1/release/", ReleaseAPI{db: d})
+	mux.Handle("/v1/stemcell", StemcellAPI{db: d})
+	mux.Handle("/v1/stemcell/", StemcellAPI{db: d})
+	mux.Handle("/v1/cache", CacheAPI{})
+	mux.Handle("/v1/keys", KeysAPI{})
+	mux.Handle("/v1/export", AdminAPI{db: d})
+	mux.Handle("/v1/import", AdminAPI{db: d})
+	mux.Handle("/v1/advisories", AdvisoryAPI{db: d})
+	mux.Handle("/v1/advisories/", AdvisoryAPI{db: d})
+	mux.Handle("/v1/stats/", StatsAPI{db: d})
+	mux.Handle("/metrics", MetricsAPI{db: d})
+	mux.Handle("/healthz", HealthAPI{db: d})
+	mux.Handle("/readyz", HealthAPI{db: d})
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "3000"
+	}
+	grace := 8 * time.Second
+	if s := os.Getenv("SHUTDOWN_TIMEOUT"); s != "" {
+		if t, err := time.ParseDuration(s); err == nil {
+			grace = t
+		} else {
+			log.Errorf("Ignoring invalid SHUTDOWN_TIMEOUT '%s': %s", s, err)
+		}
+	}
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", port),
+		Handler: instrument(mux),
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Infof("listening on *:%s", port)
+		errs <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		log.Errorf("Unable to serve on *:%s: %s", port, err)
+	case sig := <-stop:
+		log.Infof("received %s; shutting down (waiting up to %s)", sig, grace)
+		shutdown(d, srv, time.Now().Add(grace))
+	}
+}
 
+// shutdown stops the server gracefully: it stops accepting connections,
+// lets in-flight requests and version checks finish (until the deadline,
+// after which unfinished checks are checkpointed for the next start),
+// writes out download counts, and closes the database (once nothing is
+// using it any more).
+func shutdown(d *db.DB, srv *http.Server, deadline time.Time) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("unable to finish all in-flight requests: %s", err)
+	}
+
+	left := DrainChecks(d, deadline)
+	downloads.Flush(d)
+
+	/* checks that didn't finish in time can't be stopped part way, and
+	   go-db can't be disconnected safely while they are still using it,
+	   so leave it be, and let the exit take care of it */
+	if left > 0 {
+		log.Infof("leaving the database connected for %d unfinished version check(s)", left)
+	} else {
+		if err := d.Disconnect(); err != nil {
+			log.Errorf("unable to disconnect from the database: %s", err)
+		}
+		if err := closePools(); err != nil {
+			log.Errorf("unable to disconnect from the database: %s", err)
+		}
+	}
+	log.Infof("genesis-index shut down")
+}
+
+// connect sets up the backing database (and change notification bus)
+// from the environment, logging (and returning nil) if it can't.
+func connect() *db.DB {
 	var d *db.DB
 	if dsn, err := ParseVcap(os.Getenv("VCAP_SERVICES"), []string{"postgres", "postgresql"}, "uri"); err == nil {
 		d, err = Database("postgres", fmt.Sprintf("%s?sslmode=disable", dsn))
 		if err != nil {
 			log.Infof("Unable to connect to database: %s", err)
-			return
+			return nil
 		}
+		b, err := NewPostgresBus(d, fmt.Sprintf("%s?sslmode=disable", dsn))
+		if err != nil {
+			log.Infof("Unable to listen for change notifications: %s", err)
+			return nil
+		}
+		bus = b
 	} else if file := os.Getenv("SQLITE_DB"); file != "" {
 		d, err = Database("sqlite3", file)
 		if err != nil {
 			log.Infof("Unable to connect to database: %s", err)
-			return
+			return nil
 		}
 	} else {
 		if err != nil {
@@ -43,23 +234,41 @@ func main() {
 		log.Errorf("Unable to determine DSN for backing database")
 		log.Errorf("No service tagged 'postgres' is bound (per the VCAP_SERVICES environment variable)")
 		log.Errorf("and SQLITE_DB environment variable is not set.")
-		return
+		return nil
 	}
 
-	/* clean house */
-	d.Exec(`DELETE FROM release_versions WHERE valid = 0`)
+	return d
+}
 
-	/* set up the server */
-	mux := http.NewServeMux()
-	mux.Handle("/v1/release", ReleaseAPI{db: d})
-	mux.Handle("/v1/release/", ReleaseAPI{db: d})
-	mux.Handle("/v1/stemcell", StemcellAPI{db: d})
-	mux.Handle("/v1/stemcell/", StemcellAPI{db: d})
+// configureBlobstore sets up tarball mirroring from the environment,
+// logging (and returning false) if it is misconfigured.
+func configureBlobstore() bool {
+	switch os.Getenv("BLOBSTORE") {
+	case "s3":
+		b, err := NewS3Blobstore(os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET"), os.Getenv("S3_REGION"),
+			os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"), os.Getenv("S3_PRESIGN") != "no")
+		if err != nil {
+			log.Errorf("Unable to set up S3 blobstore: %s", err)
+			return false
+		}
+		blobs = b
+		log.Infof("mirroring tarballs to bucket %s at %s", b.Bucket, b.Endpoint)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
+	case "local", "":
+		if dir := os.Getenv("BLOBSTORE_DIR"); dir != "" {
+			b, err := NewLocalBlobstore(dir)
+			if err != nil {
+				log.Errorf("Unable to set up blobstore in %s: %s", dir, err)
+				return false
+			}
+			blobs = b
+			log.Infof("mirroring tarballs to %s", dir)
+		}
+
+	default:
+		log.Errorf("Unrecognized BLOBSTORE type '%s' (must be either 'local' or 's3')", os.Getenv("BLOBSTORE"))
+		return false
 	}
-	log.Infof("listening on *:%s", port)
-	http.ListenAndServe(fmt.Sprintf(":%s", port), mux)
+
+	return true
 }
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+// Metrics are kept in memory, and exposed at /metrics in the Prometheus
+// text exposition format.  There are only a handful of them, so rather
+// than pull in the whole Prometheus client library, this file has just
+// enough of a counter / histogram implementation to get by.
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type series struct {
+	labels []string
+	value  float64
+
+	/* histograms only */
+	buckets []uint64
+	count   uint64
+}
+
+// A metric is a counter or a histogram, with zero or more labels.
+type metric struct {
+	lock    sync.Mutex
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+var metrics struct {
+	lock sync.Mutex
+	all  []*metric
+}
+
+func newMetric(kind, name, help string, buckets []float64, labels ...string) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+
+	metrics.lock.Lock()
+	metrics.all = append(metrics.all, m)
+	metrics.lock.Unlock()
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return newMetric("counter", name, help, nil, labels...)
+}
+
+func newHistogram(name, help string, labels ...string) *metric {
+	return newMetric("histogram", name, help, defaultBuckets, labels...)
+}
+
+// get returns the series for a set of label values, creating it if it
+// doesn't exist yet.  The caller must hold the lock.
+func (m *metric) get(values []string) (*series, error) {
+	if len(values) != len(m.labels) {
+		return nil, fmt.Errorf("metric %s takes %d label(s), not %d", m.name, len(m.labels), len(values))
+	}
+	key := strings.Join(values, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: values, buckets: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s, nil
+}
+
+// Add adds n to a counter.  A mistake in the label values is logged,
+// and the update dropped; metrics are never worth failing a request.
+func (m *metric) Add(n float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, err := m.get(values)
+	if err != nil {
+		log.Errorf("unable to update metrics: %s", err)
+		return
+	}
+	s.value += n
+}
+
+// Inc adds one to a counter.
+func (m *metric) Inc(values ...string) {
+	m.Add(1, values...)
+}
+
+// Observe records a single observation in a histogram.
+func (m *metric) Observe(v float64, values ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s, err := m.get(values)
+	if err != nil {
+		log.Errorf("unable to update metrics: %s", err)
+		return
+	}
+	for i, le := range m.buckets {
+		if v <= le {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// Since records how long it has been since t, in seconds, in a histogram.
+func (m *metric) Since(t time.Time, values ...string) {
+	m.Observe(time.Since(t).Seconds(), values...)
+}
+
+func labelset(names, values []string, extra ...string) string {
+	var l []string
+	for i := range names {
+		l = append(l, fmt.Sprintf(`%s="%s"`, names[i], escapeLabel(values[i])))
+	}
+	l = append(l, extra...)
+	if len(l) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(l, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func (m *metric) write(out io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(out, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(out, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != "histogram" {
+			fmt.Fprintf(out, "%s%s %g\n", m.name, labelset(m.labels, s.labels), s.value)
+			continue
+		}
+		for i, le := range m.buckets {
+			fmt.Fprintf(out, "%s_bucket%s %d\n", m.name, labelset(m.labels, s.labels, fmt.Sprintf(`le="%g"`, le)), s.buckets[i])
+		}
+		fmt.Fprintf(out, "%s_bucket%s %d\n", m.name, labelset(m.labels, s.labels, `le="+Inf"`), s.count)
+		fmt.Fprintf(out, "%s_sum%s %g\n", m.name, labelset(m.labels, s.labels), s.value)
+		fmt.Fprintf(out, "%s_count%s %d\n", m.name, labelset(m.labels, s.labels), s.count)
+	}
+}
+
+// sample writes out a metric whose values are worked out when /metrics
+// is scraped, rather than being tracked as things happen.
+func sample(out io.Writer, kind, name, help string, names []string, values map[string]float64) {
+	fmt.Fprintf(out, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(out, "# TYPE %s %s\n", name, kind)
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var l []string
+		if len(names) > 0 {
+			l = strings.Split(k, "\x00")
+		}
+		fmt.Fprintf(out, "%s%s %g\n", name, labelset(names, l), values[k])
+	}
+}
+
+var (
+	httpRequests = newCounter("genesis_index_http_requests_total",
+		"HTTP requests handled, by route, method and status code.", "route", "method", "code")
+	httpDuration = newHistogram("genesis_index_http_request_duration_seconds",
+		"How long HTTP requests took to handle, by route.", "route")
+	checkOutcomes = newCounter("genesis_index_checks_total",
+		"Version checks finished, by kind and outcome.", "kind", "outcome")
+	downloadBytes = newCounter("genesis_index_upstream_download_bytes_total",
+		"Bytes downloaded from upstream, while checking versions.")
+	downloadDuration = newHistogram("genesis_index_upstream_download_duration_seconds",
+		"How long downloads from upstream took, by outcome.", "outcome")
+	dbDuration = newHistogram("genesis_index_db_query_duration_seconds",
+		"How long database statements took to run, by operation (exec or query).", "op")
+)
+
+// Database statements are timed by wrapping the database/sql driver that
+// go-db ends up using.  database/sql decides what a driver can do by
+// checking which of the optional interfaces its connections (and
+// statements) implement, so the wrappers implement all of them, and
+// pass each one through to the real driver, or act the way database/sql
+// would if the driver didn't implement it.  Either way, the wrapped
+// driver behaves just like the real one; it just takes notes.
+
+type timedDriver struct{ driver.Driver }
+type timedConn struct{ driver.Conn }
+type timedStmt struct {
+	driver.Stmt
+	conn driver.Conn
+}
+
+func (d timedDriver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.Driver.Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return timedConn{c}, nil
+}
+
+// observe records how long a statement took to run, unless the driver
+// skipped it (in which case database/sql will run it some other way,
+// and it will be timed then).
+func observe(start time.Time, op string, err error) {
+	if err != driver.ErrSkip {
+		dbDuration.Since(start, op)
+	}
+}
+
+// positional converts statement arguments for drivers that only take
+// them positionally, the way database/sql itself does.
+func positional(args []driver.NamedValue) ([]driver.Value, error) {
+	l := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, fmt.Errorf("database driver does not support named parameters (like '%s')", arg.Name)
+		}
+		l[i] = arg.Value
+	}
+	return l, nil
+}
+
+func (c timedConn) Prepare(query string) (driver.Stmt, error) {
+	s, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return timedStmt{Stmt: s, conn: c.Conn}, nil
+}
+
+func (c timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	p, ok := c.Conn.(driver.ConnPrepareContext)
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Prepare(query)
+	}
+
+	s, err := p.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return timedStmt{Stmt: s, conn: c.Conn}, nil
+}
+
+func (c timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		return nil, fmt.Errorf("database driver does not support non-default isolation levels")
+	}
+	if opts.ReadOnly {
+		return nil, fmt.Errorf("database driver does not support read-only transactions")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.Conn.Begin()
+}
+
+func (c timedConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	e, ok := c.Conn.(driver.Execer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	res, err := e.Exec(query, args)
+	observe(start, "exec", err)
+	return res, err
+}
+
+func (c timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		if _, ok := c.Conn.(driver.Execer); !ok {
+			return nil, driver.ErrSkip
+		}
+		l, err := positional(args)
+		if err != nil {
+			return nil, err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Exec(query, l)
+	}
+
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	observe(start, "exec", err)
+	return res, err
+}
+
+func (c timedConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.Queryer)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := q.Query(query, args)
+	observe(start, "query", err)
+	return rows, err
+}
+
+func (c timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		if _, ok := c.Conn.(driver.Queryer); !ok {
+			return nil, driver.ErrSkip
+		}
+		l, err := positional(args)
+		if err != nil {
+			return nil, err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		return c.Query(query, l)
+	}
+
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	observe(start, "query", err)
+	return rows, err
+}
+
+func (c timedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c timedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c timedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+func (c timedConn) CheckNamedValue(v *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+func (s timedStmt) Exec(args []driver.Value) (driver.Result, error) {
+	defer dbDuration.Since(time.Now(), "exec")
+	return s.Stmt.Exec(args)
+}
+
+func (s timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		l, err := positional(args)
+		if err != nil {
+			return nil, err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		return s.Exec(l)
+	}
+
+	defer dbDuration.Since(time.Now(), "exec")
+	return e.ExecContext(ctx, args)
+}
+
+func (s timedStmt) Query(args []driver.Value) (driver.Rows, error) {
+	defer dbDuration.Since(time.Now(), "query")
+	return s.Stmt.Query(args)
+}
+
+func (s timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		l, err := positional(args)
+		if err != nil {
+			return nil, err
+		}
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		return s.Query(l)
+	}
+
+	defer dbDuration.Since(time.Now(), "query")
+	return q.QueryContext(ctx, args)
+}
+
+// CheckNamedValue defers to the statement, then to its connection, since
+// database/sql won't look at the connection once a statement implements
+// driver.NamedValueChecker itself (as this one has to).
+func (s timedStmt) CheckNamedValue(v *driver.NamedValue) error {
+	if n, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(v)
+	}
+	if n, ok := s.conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+// ColumnConverter is what database/sql falls back to when CheckNamedValue
+// skips an argument.
+func (s timedStmt) ColumnConverter(idx int) driver.ValueConverter {
+	if c, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return c.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+var timedDrivers = struct {
+	sync.Mutex
+	registered map[string]bool
+}{registered: make(map[string]bool)}
+
+// timed registers (once) a version of a database/sql driver that times
+// every statement, and returns its name.
+func timed(name string) (string, error) {
+	timedDrivers.Lock()
+	defer timedDrivers.Unlock()
+
+	wrapped := "timed-" + name
+	if timedDrivers.registered[wrapped] {
+		return wrapped, nil
+	}
+
+	/* sql.Open doesn't connect; it just looks the driver up */
+	o, err := sql.Open(name, "")
+	if err != nil {
+		return "", err
+	}
+	drv := o.Driver()
+	o.Close()
+
+	sql.Register(wrapped, timedDriver{drv})
+	timedDrivers.registered[wrapped] = true
+	return wrapped, nil
+}
+
+type MetricsAPI struct {
+	db *db.DB
+}
+
+func (api MetricsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case match(r, `GET /metrics`):
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(200)
+
+		metrics.lock.Lock()
+		for _, m := range metrics.all {
+			m.write(w)
+		}
+		metrics.lock.Unlock()
+
+		stats := cache.Stats()
+		sample(w, "counter", "genesis_index_cache_hits_total", "Read cache hits.", nil,
+			map[string]float64{"": float64(stats.Hits)})
+		sample(w, "counter", "genesis_index_cache_misses_total", "Read cache misses.", nil,
+			map[string]float64{"": float64(stats.Misses)})
+		sample(w, "gauge", "genesis_index_cache_entries", "Entries in the read cache.", nil,
+			map[string]float64{"": float64(stats.Entries)})
+
+		versions := make(map[string]float64)
+		for _, kind := range []string{"release", "stemcell"} {
+			n, err := api.db.Count(fmt.Sprintf(`SELECT * FROM %s_versions WHERE valid = 1`, kind))
+			if err != nil {
+				log.Errorf("unable to count valid %s versions for /metrics: %s", kind, err)
+				continue
+			}
+			versions[kind] = float64(n)
+		}
+		sample(w, "gauge", "genesis_index_check_backlog", "Version checks waiting on (or running).", nil,
+			map[string]float64{"": float64(Backlog())})
+		sample(w, "gauge", "genesis_index_versions", "Valid versions in the index, by kind.", []string{"kind"}, versions)
+		return
+	}
+
+	w.WriteHeader(404)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+// ReleaseNotes are the (markdown) release notes for a single version
+// of a release.  Source is where they came from: "submitted" if they
+// were given to us directly, or "github:owner/repo" if we went and
+// got them from the GitHub releases API.
+type ReleaseNotes struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Notes   string `json:"notes"`
+	Source  string `json:"source,omitempty"`
+}
+
+// githubNotes retrieves the body of the GitHub release for version, in
+// the given owner/repo.  Release tags come in both `v1.2.3` and `1.2.3`
+// styles, so we try both.  The API base URL can be overridden (i.e. for
+// GitHub Enterprise, or for testing) via $GITHUB_API, and requests are
+// authenticated with $GITHUB_TOKEN, if it is set.
+func githubNotes(repo, version string) (string, error) {
+	base := strings.TrimSuffix(os.Getenv("GITHUB_API"), "/")
+	if base == "" {
+		base = "https://api.github.com"
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	for _, tag := range []string{"v" + version, version} {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/repos/%s/releases/tags/%s", base, repo, tag), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Accept", "application/vnd.github+json")
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		if res.StatusCode == 404 {
+			res.Body.Close()
+			continue
+		}
+		if res.StatusCode != 200 {
+			res.Body.Close()
+			return "", fmt.Errorf("GET %s returned %s", req.URL, res.Status)
+		}
+
+		var release struct {
+			Body string `json:"body"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&release)
+		res.Body.Close()
+		return release.Body, err
+	}
+
+	return "", fmt.Errorf("no GitHub release found for v%s in %s", version, repo)
+}
+
+// captureReleaseNotes stores release notes for a freshly checked
+// version: the submitted notes if there are any, otherwise whatever
+// GitHub has for it (if the release has a GitHub repo configured, and
+// nobody has submitted notes for the version already).
+func captureReleaseNotes(d *db.DB, release Release, version, notes string) {
+	source := "submitted"
+	if notes == "" {
+		if release.GitHub == "" {
+			return
+		}
+		n, err := d.Count(`SELECT * FROM release_versions WHERE name = $1 AND version = $2 AND notes_source = $3`,
+			release.Name, version, source)
+		if err != nil || n != 0 {
+			return
+		}
+
+		source = "github:" + release.GitHub
+		if notes, err = githubNotes(release.GitHub, version); err != nil {
+			log.Errorf("unable to retrieve release notes for version '%s' of '%s': %s", version, release.Name, err)
+			return
+		}
+	}
+
+	if err := SetReleaseNotes(d, release.Name, version, notes, source); err != nil {
+		log.Errorf("unable to store release notes for version '%s' of '%s': %s", version, release.Name, err)
+	}
+}
+
+// SetReleaseGitHub configures (or, with an empty repo, clears) the
+// GitHub repository that release notes are pulled from.
+func SetReleaseGitHub(d *db.DB, name, repo string) error {
+	if err := validGitHub(repo); err != nil {
+		return err
+	}
+	err := d.Exec(`UPDATE releases SET github = $2 WHERE name = $1`, name, repo)
+	if err != nil {
+		return err
+	}
+
+	touch(d, "release", name)
+	return nil
+}
+
+func validGitHub(repo string) error {
+	if repo != "" && !regexp.MustCompile(`^[\w.-]+/[\w.-]+$`).MatchString(repo) {
+		return fmt.Errorf("invalid GitHub repository '%s' (must be 'owner/repo')", repo)
+	}
+	return nil
+}
+
+func SetReleaseNotes(d *db.DB, name, version, notes, source string) error {
+	err := d.Exec(`UPDATE release_versions SET notes = $3, notes_source = $4 WHERE name = $1 AND version = $2`,
+		name, version, notes, source)
+	if err != nil {
+		return err
+	}
+
+	touch(d, "release", name)
+	return nil
+}
+
+func FindReleaseNotes(d *db.DB, name, version string) (ReleaseNotes, error) {
+	o := ReleaseNotes{Name: name, Version: version}
+
+	r, err := d.Query(`
+SELECT notes, notes_source
+  FROM release_versions
+ WHERE name = $1
+   AND version = $2
+   AND valid = 1`, name, version)
+	if err != nil {
+		return o, err
+	}
+	defer r.Close()
+
+	if !r.Next() {
+		return o, fmt.Errorf("version '%s' of release '%s' not found", version, name)
+	}
+	err = r.Scan(&o.Notes, &o.Source)
+	return o, err
+}
+
+// FindReleaseNotesRange returns the release notes for every version
+// that an upgrade from one version to another would pick up; that is,
+// everything after from, up to and including to (or the latest version
+// if to is empty), newest first.
+func FindReleaseNotesRange(d *db.DB, name, from, to string) ([]ReleaseNotes, error) {
+	l := make([]ReleaseNotes, 0)
+
+	lo, err := vnum(from)
+	if err != nil {
+		return l, fmt.Errorf("invalid version '%s'", from)
+	}
+	hi := uint64(1<<63 - 1)
+	if to != "" {
+		if hi, err = vnum(to); err != nil {
+			return l, fmt.Errorf("invalid version '%s'", to)
+		}
+	}
+
+	r, err := d.Query(`
+SELECT version, notes, notes_source
+  FROM release_versions
+ WHERE name = $1
+   AND valid = 1
+   AND vnum > $2
+   AND vnum <= $3
+ ORDER BY vnum DESC`, name, lo, hi)
+	if err != nil {
+		return l, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		o := ReleaseNotes{Name: name}
+		if err = r.Scan(&o.Version, &o.Notes, &o.Source); err != nil {
+			return l, err
+		}
+		l = append(l, o)
+	}
+
+	return l, nil
+}
+
+// markdown combines one or more sets of release notes into a single
+// markdown document, with a heading per version.
+func markdown(l []ReleaseNotes) []byte {
+	var b bytes.Buffer
+	for _, n := range l {
+		fmt.Fprintf(&b, "## %s v%s\n\n", n.Name, n.Version)
+		if notes := strings.TrimSpace(n.Notes); notes != "" {
+			fmt.Fprintf(&b, "%s\n\n", notes)
+		} else {
+			fmt.Fprintf(&b, "_(no release notes)_\n\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// wantsMarkdown decides whether to send release notes as markdown,
+// rather than JSON, via either ?format=markdown or the Accept header.
+func wantsMarkdown(r *http.Request) bool {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f == "markdown" || f == "md"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/markdown")
+}
+
+// notesFormat names the representation wantsMarkdown picked, so that
+// it can be folded into the ETag.
+func notesFormat(r *http.Request) string {
+	if wantsMarkdown(r) {
+		return "markdown"
+	}
+	return "json"
+}
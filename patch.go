@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jhunt/go-db"
+)
+
+// An ArtifactPatch is a partial update to the metadata of a release or
+// stemcell; only the fields that are given are changed.  Versions are
+// left alone, unless Recheck is set, in which case every known version
+// is re-verified (in the background) against the updated metadata.
+type ArtifactPatch struct {
+	URL          *string   `json:"url"`
+	URLs         *[]string `json:"urls"`
+	Disabled     *bool     `json:"disabled"`
+	Mirror       *bool     `json:"mirror"`
+	SignatureURL *string   `json:"signature_url"`
+	TrustedKeys  *[]string `json:"trusted_keys"`
+	GitHub       *string   `json:"github"`
+	Recheck      bool      `json:"recheck"`
+
+	RequestID string `json:"-"`
+}
+
+// PatchArtifact applies a patch to a release or stemcell, in a single
+// UPDATE, so that either all of the changes are made, or none are.
+func PatchArtifact(d *db.DB, kind, name string, p ArtifactPatch) error {
+	r, err := d.Query(fmt.Sprintf(`SELECT sig_url, sig_keys FROM %ss WHERE name = $1`, kind), name)
+	if err != nil {
+		return err
+	}
+	if !r.Next() {
+		r.Close()
+		return fmt.Errorf("%s '%s' not found", kind, name)
+	}
+	var sigurl, keys string
+	err = r.Scan(&sigurl, &keys)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	var set []string
+	var args []interface{}
+	update := func(column string, value interface{}) {
+		args = append(args, value)
+		set = append(set, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+
+	if p.URL != nil {
+		if *p.URL == "" {
+			return fmt.Errorf("url cannot be empty")
+		}
+		if err = checkTemplate(kind, *p.URL); err != nil {
+			return err
+		}
+		update("url", *p.URL)
+	}
+	if p.URLs != nil {
+		if p.URL != nil {
+			return fmt.Errorf("specify either url or urls, not both")
+		}
+		url, fallbacks, err := checkTemplates(kind, *p.URLs)
+		if err != nil {
+			return err
+		}
+		update("url", url)
+		update("fallback_urls", fallbacks)
+	}
+	if p.Disabled != nil {
+		update("disabled", *p.Disabled)
+	}
+	if p.Mirror != nil {
+		update("mirror", *p.Mirror)
+	}
+	if p.GitHub != nil {
+		if kind != "release" {
+			return fmt.Errorf("only releases can have a github repository")
+		}
+		if err = validGitHub(*p.GitHub); err != nil {
+			return err
+		}
+		update("github", *p.GitHub)
+	}
+	if p.SignatureURL != nil || p.TrustedKeys != nil {
+		trusted := trustedKeys(keys)
+		if p.SignatureURL != nil {
+			sigurl = *p.SignatureURL
+		}
+		if p.TrustedKeys != nil {
+			trusted = *p.TrustedKeys
+		}
+		if trusted == nil {
+			trusted = []string{}
+		}
+		if err = checkVerification(kind, sigurl, trusted); err != nil {
+			return err
+		}
+		b, err := json.Marshal(trusted)
+		if err != nil {
+			return err
+		}
+		update("sig_url", sigurl)
+		update("sig_keys", string(b))
+	}
+
+	if len(set) > 0 {
+		err = d.Exec(fmt.Sprintf(`UPDATE %ss SET %s WHERE name = $%d`, kind, strings.Join(set, ", "), len(args)+1),
+			append(args, name)...)
+		if err != nil {
+			return err
+		}
+		touch(d, kind, name)
+	}
+
+	if p.Recheck {
+		if kind == "release" {
+			return RecheckReleaseVersions(d, name, p.RequestID)
+		}
+		return RecheckStemcellVersions(d, name, p.RequestID)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+// A Revision identifies one particular state of a tracked artifact
+// (or of a whole collection of them), and is what we hand out to
+// clients as ETag / Last-Modified for conditional GETs.
+type Revision struct {
+	ETag     string
+	Modified time.Time
+}
+
+func (rev Revision) Known() bool {
+	return rev.ETag != ""
+}
+
+// As returns the revision of one particular representation (i.e. JSON,
+// or markdown) of an artifact, for endpoints that negotiate what they
+// send back; a cached copy of one must never revalidate as the other.
+func (rev Revision) As(representation string) Revision {
+	if rev.Known() {
+		rev.ETag = etag(rev.ETag, representation)
+	}
+	return rev
+}
+
+func etag(parts ...string) string {
+	return fmt.Sprintf(`"%x"`, sha1.Sum([]byte(strings.Join(parts, "\n"))))
+}
+
+// touch bumps the revision counter of the named artifact, drops
+// anything we have cached for it, and tells the other instances on
+// the bus to do the same.  It must be called by every code
+// path that changes what a GET against that artifact (or against its
+// collection) would return.
+func touch(d *db.DB, kind, name string) {
+	cache.Invalidate(kind, name)
+
+	now := time.Now().Unix()
+	err := upsert(d, `
+UPDATE revisions
+   SET revision = revision + 1,
+       updated  = $1
+
+ WHERE kind = $2
+   AND name = $3`, []interface{}{now, kind, name},
+		`INSERT INTO revisions (kind, name, revision, updated) VALUES ($1, $2, 1, $3)`,
+		kind, name, now)
+	if err != nil {
+		log.Errorf("unable to bump revision of %s '%s': %s", kind, name, err)
+	}
+
+	if err = bus.Publish(Event{Kind: kind, Name: name}); err != nil {
+		log.Errorf("unable to publish change to %s '%s': %s", kind, name, err)
+	}
+}
+
+func ArtifactRevision(d *db.DB, kind, name string) Revision {
+	var rev Revision
+
+	r, err := d.Query(fmt.Sprintf(`
+SELECT
+  r.revision,
+  r.updated
+
+FROM
+  revisions r
+  INNER JOIN %ss a
+          ON a.name = r.name
+
+WHERE r.kind = $1
+  AND r.name = $2`, kind), kind, name)
+	if err != nil {
+		log.Debugf("unable to determine revision of %s '%s': %s", kind, name, err)
+		return rev
+	}
+	defer r.Close()
+
+	if !r.Next() {
+		return rev
+	}
+
+	var n, updated int64
+	if err = r.Scan(&n, &updated); err != nil {
+		log.Debugf("unable to determine revision of %s '%s': %s", kind, name, err)
+		return rev
+	}
+
+	rev.ETag = etag(kind, name, fmt.Sprintf("%d", n))
+	rev.Modified = time.Unix(updated, 0).UTC()
+	return rev
+}
+
+func CollectionRevision(d *db.DB, kind string) Revision {
+	var rev Revision
+
+	/* deleted artifacts keep their revisions rows, so that dropping
+	   one still changes the ETag and Last-Modified of the collection */
+	r, err := d.Query(`
+SELECT
+  name,
+  revision,
+  updated
+
+FROM revisions
+
+WHERE kind = $1
+
+ORDER BY
+  name ASC`, kind)
+	if err != nil {
+		log.Debugf("unable to determine revision of all %ss: %s", kind, err)
+		return rev
+	}
+	defer r.Close()
+
+	parts := []string{kind}
+	var latest int64
+	for r.Next() {
+		var name string
+		var n, updated int64
+		if err = r.Scan(&name, &n, &updated); err != nil {
+			log.Debugf("unable to determine revision of all %ss: %s", kind, err)
+			return rev
+		}
+		parts = append(parts, fmt.Sprintf("%s@%d", name, n))
+		if updated > latest {
+			latest = updated
+		}
+	}
+
+	rev.ETag = etag(parts...)
+	rev.Modified = time.Unix(latest, 0).UTC()
+	return rev
+}
+
+// notModified sets the ETag and Last-Modified headers for rev and,
+// if the request's If-None-Match / If-Modified-Since preconditions
+// say the client already has it, answers with a 304 and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, rev Revision) bool {
+	if !rev.Known() {
+		return false
+	}
+
+	w.Header().Set("ETag", rev.ETag)
+	w.Header().Set("Last-Modified", rev.Modified.Format(http.TimeFormat))
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == rev.ETag {
+				w.WriteHeader(304)
+				return true
+			}
+		}
+		/* If-Modified-Since is ignored when If-None-Match is present */
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err == nil && !rev.Modified.After(t) {
+			w.WriteHeader(304)
+			return true
+		}
+	}
+
+	return false
+}
@@ -2,17 +2,26 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/jhunt/go-db"
 )
 
+// schema is kept around after migrating, so that readiness checks can
+// make sure the database is (still) at the latest version.
+var schema *db.Schema
+
 func Database(driver, dsn string) (*db.DB, error) {
+	driver, err := timed(driver)
+	if err != nil {
+		return nil, err
+	}
 	d := &db.DB{
 		Driver: driver,
 		DSN:    dsn,
 	}
 
-	err := d.Connect()
+	err = d.Connect()
 	if err != nil {
 		return nil, err
 	}
@@ -89,11 +98,318 @@ func Database(driver, dsn string) (*db.DB, error) {
 
 		return nil
 	}) // }}}
+	s.Version(4, func(d *db.DB) error { // {{{
+		err = d.Exec(`
+  CREATE TABLE revisions (
+    kind      VARCHAR(20)   NOT NULL,
+    name      VARCHAR(200)  NOT NULL,
+    revision  BIGINT        NOT NULL DEFAULT 0,
+    updated   BIGINT        NOT NULL DEFAULT 0,
+
+    UNIQUE (kind, name)
+  )
+`)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().Unix()
+		for _, kind := range []string{"release", "stemcell"} {
+			err = d.Exec(fmt.Sprintf(`
+  INSERT INTO revisions (kind, name, revision, updated)
+    SELECT '%s', name, 1, $1 FROM %ss
+`, kind, kind), now)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}) // }}}
+	s.Version(5, func(d *db.DB) error { // {{{
+		for _, kind := range []string{"release", "stemcell"} {
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %ss
+    ADD COLUMN mirror BOOL DEFAULT false
+`, kind))
+			if err != nil {
+				return err
+			}
+
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %s_versions
+    ADD COLUMN sha256 VARCHAR(200) NOT NULL DEFAULT ''
+`, kind))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}) // }}}
+	s.Version(6, func(d *db.DB) error { // {{{
+		for _, table := range []string{"releases", "stemcells", "release_versions", "stemcell_versions"} {
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %s
+    ADD COLUMN origin TEXT NOT NULL DEFAULT ''
+`, table))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(7, func(d *db.DB) error { // {{{
+		for _, kind := range []string{"release", "stemcell"} {
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %ss
+    ADD COLUMN sig_url TEXT NOT NULL DEFAULT ''
+`, kind))
+			if err != nil {
+				return err
+			}
+
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %ss
+    ADD COLUMN sig_keys TEXT NOT NULL DEFAULT ''
+`, kind))
+			if err != nil {
+				return err
+			}
+
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %s_versions
+    ADD COLUMN signer TEXT NOT NULL DEFAULT ''
+`, kind))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(8, func(d *db.DB) error { // {{{
+		err = d.Exec(`
+  ALTER TABLE releases
+    ADD COLUMN github TEXT NOT NULL DEFAULT ''
+`)
+		if err != nil {
+			return err
+		}
+
+		err = d.Exec(`
+  ALTER TABLE release_versions
+    ADD COLUMN notes TEXT NOT NULL DEFAULT ''
+`)
+		if err != nil {
+			return err
+		}
+
+		err = d.Exec(`
+  ALTER TABLE release_versions
+    ADD COLUMN notes_source TEXT NOT NULL DEFAULT ''
+`)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(9, func(d *db.DB) error { // {{{
+		err = d.Exec(`
+  CREATE TABLE advisories (
+    id          VARCHAR(200) NOT NULL PRIMARY KEY,
+    severity    VARCHAR(20)  NOT NULL,
+    description TEXT         NOT NULL DEFAULT '',
+    url         TEXT         NOT NULL DEFAULT '',
+    created     INTEGER      NOT NULL
+  )
+`)
+		if err != nil {
+			return err
+		}
+
+		err = d.Exec(`
+  CREATE TABLE advisory_targets (
+    advisory VARCHAR(200) NOT NULL,
+    kind     VARCHAR(20)  NOT NULL,
+    name     VARCHAR(200) NOT NULL,
+    versions TEXT         NOT NULL DEFAULT '[]'
+  )
+`)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(10, func(d *db.DB) error { // {{{
+		for _, kind := range []string{"release", "stemcell"} {
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %s_versions
+    ADD COLUMN yanked_at INTEGER NOT NULL DEFAULT 0
+`, kind))
+			if err != nil {
+				return err
+			}
+
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %s_versions
+    ADD COLUMN yank_reason TEXT NOT NULL DEFAULT ''
+`, kind))
+			if err != nil {
+				return err
+			}
+
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %s_versions
+    ADD COLUMN yank_replacement TEXT NOT NULL DEFAULT ''
+`, kind))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(11, func(d *db.DB) error { // {{{
+		err = d.Exec(`
+  ALTER TABLE stemcells
+    ADD COLUMN disabled BOOL DEFAULT false
+`)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(12, func(d *db.DB) error { // {{{
+		err = d.Exec(`
+  CREATE TABLE aliases (
+    kind    VARCHAR(20)  NOT NULL,
+    name    VARCHAR(200) NOT NULL,
+    target  VARCHAR(200) NOT NULL,
+    created INTEGER      NOT NULL,
+
+    PRIMARY KEY (kind, name)
+  )
+`)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(13, func(d *db.DB) error { // {{{
+		for _, kind := range []string{"release", "stemcell"} {
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %ss
+    ADD COLUMN fallback_urls TEXT NOT NULL DEFAULT '[]'
+`, kind))
+			if err != nil {
+				return err
+			}
+
+			err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %s_versions
+    ADD COLUMN urls TEXT NOT NULL DEFAULT '[]'
+`, kind))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(14, func(d *db.DB) error { // {{{
+		err = d.Exec(`
+  CREATE TABLE checks (
+    kind    VARCHAR(20)  NOT NULL,
+    name    VARCHAR(200) NOT NULL,
+    version VARCHAR(20)  NOT NULL,
+    status  VARCHAR(20)  NOT NULL,
+    reason  TEXT         NOT NULL DEFAULT '',
+    updated INTEGER      NOT NULL,
+
+    PRIMARY KEY (kind, name, version)
+  )
+`)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(15, func(d *db.DB) error { // {{{
+		for _, kind := range []string{"release", "stemcell"} {
+			for _, col := range []string{
+				"size          BIGINT  NOT NULL DEFAULT 0",
+				"content_type  TEXT    NOT NULL DEFAULT ''",
+				"last_modified BIGINT  NOT NULL DEFAULT 0",
+				"etag          TEXT    NOT NULL DEFAULT ''",
+				"first_seen    BIGINT  NOT NULL DEFAULT 0",
+				"verified_at   BIGINT  NOT NULL DEFAULT 0",
+			} {
+				err = d.Exec(fmt.Sprintf(`
+  ALTER TABLE %s_versions
+    ADD COLUMN %s
+`, kind, col))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(16, func(d *db.DB) error { // {{{
+		err = d.Exec(`
+  CREATE TABLE downloads (
+    kind    VARCHAR(20)  NOT NULL,
+    name    VARCHAR(200) NOT NULL,
+    version VARCHAR(20)  NOT NULL,
+    day     VARCHAR(10)  NOT NULL,
+    agent   VARCHAR(20)  NOT NULL,
+    count   INTEGER      NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (kind, name, version, day, agent)
+  )
+`)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}) // }}}
+
+	s.Version(17, func(d *db.DB) error { // {{{
+		err = d.Exec(`
+  ALTER TABLE checks
+    ADD COLUMN request TEXT NOT NULL DEFAULT ''
+`)
+		if err != nil {
+			return err
+		}
+
+		return nil
+	}) // }}}
 
 	err = s.Migrate(d, db.Latest)
 	if err != nil {
 		return nil, err
 	}
+	schema = s
 
 	// Always recalculate vnums because it's cheap and easy
 	tables := []string{"release_versions", "stemcell_versions"}
@@ -102,17 +418,27 @@ func Database(driver, dsn string) (*db.DB, error) {
 		if err != nil {
 			return nil, err
 		}
+
+		/* read everything before updating anything; SQLite won't
+		   let us write while the query is still open */
+		var versions [][2]string
 		for r.Next() {
 			var name, version string
 			if err = r.Scan(&name, &version); err != nil {
+				r.Close()
 				return nil, err
 			}
-			n, err := vnum(version)
+			versions = append(versions, [2]string{name, version})
+		}
+		r.Close()
+
+		for _, v := range versions {
+			n, err := vnum(v[1])
 			if err != nil {
 				return nil, err
 			}
 			err = d.Exec(fmt.Sprintf(`UPDATE %s SET vnum = $1 WHERE name = $2 AND version = $3`, table),
-				n, name, version)
+				n, v[0], v[1])
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/starkandwayne/goutils/log"
+)
+
+// A Signer holds the Ed25519 key that genesis-index uses to sign the
+// version records it hands out, so that clients can tell that the
+// checksums they got really came from this index.
+type Signer struct {
+	ID  string
+	key ed25519.PrivateKey
+}
+
+// A Signature is a detached Ed25519 signature over the canonical JSON
+// form of a version record; see canonical().
+type Signature struct {
+	KeyID     string `json:"key_id"`
+	Signature string `json:"signature"`
+}
+
+type PublicKey struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"`
+}
+
+/* signer is nil until main() sets it up */
+var signer *Signer
+
+// NewSigner sets up a Signer from a base64-encoded Ed25519 seed (or
+// full private key).  Keys are never generated on the fly: a key that
+// changes on every restart is no use to clients that pin it.
+func NewSigner(seed string) (*Signer, error) {
+	var key ed25519.PrivateKey
+
+	if seed == "" {
+		return nil, fmt.Errorf("no signing key given")
+	}
+	b, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil {
+		return nil, fmt.Errorf("signing key is not valid base64: %s", err)
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		key = ed25519.NewKeyFromSeed(b)
+	case ed25519.PrivateKeySize:
+		key = ed25519.PrivateKey(b)
+	default:
+		return nil, fmt.Errorf("signing key is %d bytes long (expected %d or %d)",
+			len(b), ed25519.SeedSize, ed25519.PrivateKeySize)
+	}
+
+	pub := key.Public().(ed25519.PublicKey)
+	return &Signer{
+		ID:  fmt.Sprintf("%x", sha256.Sum256(pub))[0:16],
+		key: key,
+	}, nil
+}
+
+func (s *Signer) PublicKey() PublicKey {
+	return PublicKey{
+		ID:        s.ID,
+		Algorithm: "ed25519",
+		PublicKey: base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey)),
+	}
+}
+
+// canonical returns the exact bytes that get signed for a version
+// record: a compact JSON object, with its keys sorted, and without
+// any HTML escaping.  This is what `jq -cS` would produce, so that
+// shell clients can reconstruct it.
+func canonical(kind, name, version, sha1, sha256, url string) []byte {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(map[string]string{
+		"kind":    kind,
+		"name":    name,
+		"version": version,
+		"sha1":    sha1,
+		"sha256":  sha256,
+		"url":     url,
+	})
+	return bytes.TrimRight(b.Bytes(), "\n")
+}
+
+// sign returns the signature for a version record, or nil if we don't
+// have a signing key.
+func sign(kind, name, version, sha1, sha256, url string) *Signature {
+	if signer == nil {
+		return nil
+	}
+	msg := canonical(kind, name, version, sha1, sha256, url)
+	return &Signature{
+		KeyID:     signer.ID,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(signer.key, msg)),
+	}
+}
+
+type KeysAPI struct{}
+
+func (api KeysAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("RECV: %s %s", r.Method, r.URL.Path)
+	switch {
+	case match(r, `GET /v1/keys`):
+		keys := make([]PublicKey, 0)
+		if signer != nil {
+			keys = append(keys, signer.PublicKey())
+		}
+		respond(w, nil, 200, keys)
+		return
+	}
+
+	w.WriteHeader(404)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-db"
+)
+
+const SnapshotFormat = 1
+
+// A Snapshot is a complete, portable copy of everything in the index:
+// every release and stemcell, their URL templates and flags, and all
+// of their valid versions (with checksums).  It is what gets written
+// out by an export, and read back in by an import.
+type Snapshot struct {
+	Format    int                `json:"format"`
+	Exported  time.Time          `json:"exported"`
+	Releases  []SnapshotArtifact `json:"releases"`
+	Stemcells []SnapshotArtifact `json:"stemcells"`
+}
+
+type SnapshotArtifact struct {
+	Name     string            `json:"name"`
+	URL      string            `json:"url"`
+	Disabled bool              `json:"disabled"`
+	Mirror   bool              `json:"mirror"`
+	Versions []SnapshotVersion `json:"versions"`
+
+	URLs         []string `json:"urls,omitempty"`
+	SignatureURL string   `json:"signature_url,omitempty"`
+	TrustedKeys  []string `json:"trusted_keys,omitempty"`
+	GitHub       string   `json:"github,omitempty"`
+}
+
+type SnapshotVersion struct {
+	Version string `json:"version"`
+	SHA1    string `json:"sha1"`
+	SHA256  string `json:"sha256,omitempty"`
+	URL     string `json:"url"`
+	Yanked  *Yank  `json:"yanked,omitempty"`
+}
+
+func (v SnapshotVersion) same(o SnapshotVersion) bool {
+	return v.Version == o.Version && v.SHA1 == o.SHA1 && v.SHA256 == o.SHA256 && v.URL == o.URL &&
+		sameYank(v.Yanked, o.Yanked)
+}
+
+// A Change is one step in bringing the index in line with an imported
+// Snapshot.  Version is empty for changes to the artifact itself.
+type Change struct {
+	Action  string `json:"action"`
+	Kind    string `json:"kind"`
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+
+	artifact SnapshotArtifact
+	version  SnapshotVersion
+}
+
+func (s Snapshot) artifacts(kind string) []SnapshotArtifact {
+	if kind == "release" {
+		return s.Releases
+	}
+	return s.Stemcells
+}
+
+func ExportSnapshot(d *db.DB) (Snapshot, error) {
+	s := Snapshot{
+		Format:   SnapshotFormat,
+		Exported: time.Now().UTC(),
+	}
+
+	var err error
+	if s.Releases, err = exportArtifacts(d, "release"); err != nil {
+		return s, err
+	}
+	if s.Stemcells, err = exportArtifacts(d, "stemcell"); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+func exportArtifacts(d *db.DB, kind string) ([]SnapshotArtifact, error) {
+	l := make([]SnapshotArtifact, 0)
+
+	github := "''"
+	if kind == "release" {
+		github = "github"
+	}
+	r, err := d.Query(fmt.Sprintf(`
+SELECT name, url, disabled, mirror, sig_url, sig_keys, %s, fallback_urls
+  FROM %ss
+ ORDER BY name ASC`, github, kind))
+	if err != nil {
+		return l, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var a SnapshotArtifact
+		var keys, fallbacks string
+		if err = r.Scan(&a.Name, &a.URL, &a.Disabled, &a.Mirror, &a.SignatureURL, &keys, &a.GitHub, &fallbacks); err != nil {
+			return l, err
+		}
+		a.TrustedKeys = trustedKeys(keys)
+		if l := templates(a.URL, fallbacks); len(l) > 1 {
+			a.URLs = l
+		}
+		l = append(l, a)
+	}
+	r.Close()
+
+	for i := range l {
+		l[i].Versions = make([]SnapshotVersion, 0)
+
+		r, err := d.Query(fmt.Sprintf(`
+SELECT version, sha1, sha256, url, yanked_at, yank_reason, yank_replacement
+  FROM %s_versions
+ WHERE name = $1
+   AND valid = 1
+ ORDER BY vnum ASC`, kind), l[i].Name)
+		if err != nil {
+			return l, err
+		}
+
+		for r.Next() {
+			var v SnapshotVersion
+			var yankedAt int64
+			var yankReason, yankReplacement string
+			if err = r.Scan(&v.Version, &v.SHA1, &v.SHA256, &v.URL, &yankedAt, &yankReason, &yankReplacement); err != nil {
+				r.Close()
+				return l, err
+			}
+			v.Yanked = yanked(yankedAt, yankReason, yankReplacement)
+			l[i].Versions = append(l[i].Versions, v)
+		}
+		r.Close()
+	}
+
+	return l, nil
+}
+
+// PlanImport works out what needs to change to bring the index (as
+// currently exported in have) in line with want.  When merging, only
+// additions and updates are made; when replacing, anything in have
+// that isn't in want is deleted as well.
+func PlanImport(have, want Snapshot, replace bool) ([]Change, error) {
+	if want.Format != SnapshotFormat {
+		return nil, fmt.Errorf("unsupported export format %d", want.Format)
+	}
+
+	l := make([]Change, 0)
+	for _, kind := range []string{"release", "stemcell"} {
+		existing := make(map[string]SnapshotArtifact)
+		for _, a := range have.artifacts(kind) {
+			existing[a.Name] = a
+		}
+
+		wanted := make(map[string]bool)
+		for _, a := range want.artifacts(kind) {
+			if a.Name == "" {
+				return nil, fmt.Errorf("%s with no name found in import", kind)
+			}
+			if err := checkVerification(kind, a.SignatureURL, a.TrustedKeys); err != nil {
+				return nil, fmt.Errorf("%s '%s': %s", kind, a.Name, err)
+			}
+			if a.URLs != nil {
+				if _, _, err := checkTemplates(kind, a.URLs); err != nil {
+					return nil, fmt.Errorf("%s '%s': %s", kind, a.Name, err)
+				}
+				if a.URL != "" && a.URL != a.URLs[0] {
+					return nil, fmt.Errorf("%s '%s': url and urls disagree", kind, a.Name)
+				}
+				a.URL = a.URLs[0]
+				if len(a.URLs) == 1 {
+					a.URLs = nil
+				}
+			}
+			wanted[a.Name] = true
+
+			old, ok := existing[a.Name]
+			if !ok {
+				l = append(l, Change{Action: "create", Kind: kind, Name: a.Name, Detail: a.URL, artifact: a})
+			} else if old.URL != a.URL || strings.Join(old.URLs, "\n") != strings.Join(a.URLs, "\n") ||
+				old.Disabled != a.Disabled || old.Mirror != a.Mirror ||
+				old.SignatureURL != a.SignatureURL || strings.Join(old.TrustedKeys, "\n") != strings.Join(a.TrustedKeys, "\n") ||
+				old.GitHub != a.GitHub {
+				l = append(l, Change{Action: "update", Kind: kind, Name: a.Name,
+					Detail: fmt.Sprintf("url %s, disabled %t, mirror %t", a.URL, a.Disabled, a.Mirror), artifact: a})
+			}
+
+			versions := make(map[string]SnapshotVersion)
+			for _, v := range old.Versions {
+				versions[v.Version] = v
+			}
+			seen := make(map[string]bool)
+			for _, v := range a.Versions {
+				if _, err := vnum(v.Version); err != nil {
+					return nil, fmt.Errorf("%s '%s' has an invalid version '%s'", kind, a.Name, v.Version)
+				}
+				seen[v.Version] = true
+
+				was, ok := versions[v.Version]
+				if !ok {
+					l = append(l, Change{Action: "create", Kind: kind, Name: a.Name, Version: v.Version, Detail: v.SHA1, version: v})
+				} else if !was.same(v) {
+					detail := fmt.Sprintf("sha1 %s -> %s", was.SHA1, v.SHA1)
+					if was.SHA1 == v.SHA1 && !sameYank(was.Yanked, v.Yanked) {
+						detail = "unyanked"
+						if v.Yanked != nil {
+							detail = fmt.Sprintf("yanked: %s", v.Yanked.Reason)
+						}
+					}
+					l = append(l, Change{Action: "update", Kind: kind, Name: a.Name, Version: v.Version,
+						Detail: detail, version: v})
+				}
+			}
+
+			if replace {
+				for _, v := range old.Versions {
+					if !seen[v.Version] {
+						l = append(l, Change{Action: "delete", Kind: kind, Name: a.Name, Version: v.Version})
+					}
+				}
+			}
+		}
+
+		if replace {
+			for _, a := range have.artifacts(kind) {
+				if !wanted[a.Name] {
+					l = append(l, Change{Action: "delete", Kind: kind, Name: a.Name})
+				}
+			}
+		}
+	}
+
+	return l, nil
+}
+
+func ApplyImport(d *db.DB, changes []Change) error {
+	for _, c := range changes {
+		var err error
+
+		switch {
+		case c.Version == "" && c.Action == "create":
+			switch c.Kind {
+			case "release":
+				err = CreateRelease(d, c.Name, c.artifact.URL, c.artifact.Mirror)
+			case "stemcell":
+				err = CreateStemcell(d, c.Name, c.artifact.URL, c.artifact.Mirror)
+			}
+			if err == nil && (c.artifact.Disabled || c.artifact.URLs != nil || c.artifact.SignatureURL != "" || len(c.artifact.TrustedKeys) > 0 || c.artifact.GitHub != "") {
+				err = updateArtifact(d, c.Kind, c.artifact)
+			}
+
+		case c.Version == "" && c.Action == "update":
+			err = updateArtifact(d, c.Kind, c.artifact)
+
+		case c.Version == "" && c.Action == "delete":
+			switch c.Kind {
+			case "release":
+				err = DeleteRelease(d, c.Name)
+			case "stemcell":
+				err = DeleteStemcell(d, c.Name)
+			}
+
+		case c.Action == "create" || c.Action == "update":
+			err = register(d, c.Kind, c.Name, c.Version, c.version.SHA1, c.version.SHA256, c.version.URL)
+			if err == nil {
+				err = setYank(d, c.Kind, c.Name, c.Version, c.version.Yanked)
+			}
+
+		case c.Action == "delete":
+			switch c.Kind {
+			case "release":
+				err = DeleteReleaseVersion(d, c.Name, c.Version)
+			case "stemcell":
+				err = DeleteStemcellVersion(d, c.Name, c.Version)
+			}
+		}
+
+		if err != nil {
+			if c.Version != "" {
+				return fmt.Errorf("unable to %s %s '%s' v%s: %s", c.Action, c.Kind, c.Name, c.Version, err)
+			}
+			return fmt.Errorf("unable to %s %s '%s': %s", c.Action, c.Kind, c.Name, err)
+		}
+	}
+	return nil
+}
+
+func updateArtifact(d *db.DB, kind string, a SnapshotArtifact) error {
+	fallbacks := "[]"
+	if a.URLs != nil {
+		var err error
+		if _, fallbacks, err = checkTemplates(kind, a.URLs); err != nil {
+			return err
+		}
+	}
+
+	err := d.Exec(fmt.Sprintf(`UPDATE %ss SET url = $1, mirror = $2, disabled = $3, fallback_urls = $4 WHERE name = $5`, kind),
+		a.URL, a.Mirror, a.Disabled, fallbacks, a.Name)
+	if err != nil {
+		return err
+	}
+
+	if kind == "release" {
+		if err = SetReleaseGitHub(d, a.Name, a.GitHub); err != nil {
+			return err
+		}
+	}
+	return setVerification(d, kind, a.Name, a.SignatureURL, a.TrustedKeys)
+}
+
+// Import brings the index in line with the given Snapshot, returning
+// the list of changes that were (or, for a dry run, would be) made.
+func Import(d *db.DB, want Snapshot, replace, dryrun bool) ([]Change, error) {
+	have, err := ExportSnapshot(d)
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := PlanImport(have, want, replace)
+	if err != nil || dryrun {
+		return changes, err
+	}
+	return changes, ApplyImport(d, changes)
+}
+
+func ExportCommand(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "json", "Document format to export as, 'json' or 'yaml'")
+	output := fs.String("o", "", "Path to write the export to (defaults to standard output)")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "USAGE: genesis-index export [--format (json|yaml)] [-o FILE]\n")
+		return 1
+	}
+
+	d := connect()
+	if d == nil {
+		return 2
+	}
+
+	snapshot, err := ExportSnapshot(d)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to export the index: %s\n", err)
+		return 2
+	}
+	b, _, err := encodeSnapshot(snapshot, *format)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+
+	if *output == "" {
+		os.Stdout.Write(b)
+		return 0
+	}
+	if err = ioutil.WriteFile(*output, b, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write export to %s: %s\n", *output, err)
+		return 2
+	}
+	return 0
+}
+
+func ImportCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	mode := fs.String("mode", "merge", "How to import, 'merge' or 'replace'")
+	dryrun := fs.Bool("dry-run", false, "Show what would change, without changing anything")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || (*mode != "merge" && *mode != "replace") {
+		fmt.Fprintf(os.Stderr, "USAGE: genesis-index import [--mode (merge|replace)] [--dry-run] FILE\n")
+		return 1
+	}
+
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 2
+	}
+	snapshot, err := decodeSnapshot(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid import document %s: %s\n", fs.Arg(0), err)
+		return 2
+	}
+
+	d := connect()
+	if d == nil {
+		return 2
+	}
+
+	changes, err := Import(d, snapshot, *mode == "replace", *dryrun)
+	for _, c := range changes {
+		what := fmt.Sprintf("%s %s", c.Kind, c.Name)
+		if c.Version != "" {
+			what = fmt.Sprintf("%s/%s", what, c.Version)
+		}
+		fmt.Printf("%-6s %s  %s\n", c.Action, what, c.Detail)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to import %s: %s\n", fs.Arg(0), err)
+		return 2
+	}
+	if *dryrun {
+		fmt.Printf("(dry run; %d changes not applied)\n", len(changes))
+	}
+	return 0
+}
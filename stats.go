@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+// Tarball downloads (well, redirects) are counted per version, per day,
+// and per user agent family.  Counting happens in memory, and the
+// counts are flushed to the database in batches every so often, so
+// that downloads don't each cost a database write.
+
+type downloadKey struct {
+	kind    string
+	name    string
+	version string
+	day     string
+	agent   string
+}
+
+type DownloadCounter struct {
+	lock   sync.Mutex
+	counts map[downloadKey]int64
+}
+
+var downloads = NewDownloadCounter()
+
+func NewDownloadCounter() *DownloadCounter {
+	return &DownloadCounter{
+		counts: make(map[downloadKey]int64),
+	}
+}
+
+// Count records a single download of a version of a release or stemcell.
+// HEAD requests aren't downloads, and don't count.  Neither are ranged
+// requests, unless they start at the beginning, since resumed (or
+// parallel) downloads would otherwise count once per piece.
+func (c *DownloadCounter) Count(r *http.Request, kind, name, version string) {
+	if r.Method != "GET" {
+		return
+	}
+	if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(strings.TrimSpace(rng), "bytes=0-") {
+		return
+	}
+
+	k := downloadKey{
+		kind:    kind,
+		name:    name,
+		version: version,
+		day:     time.Now().UTC().Format("2006-01-02"),
+		agent:   agentFamily(r.UserAgent()),
+	}
+
+	c.lock.Lock()
+	c.counts[k]++
+	c.lock.Unlock()
+}
+
+// Flush writes all of the buffered download counts to the database,
+// adding them to what is already there.  Counts that can't be written
+// go back in the buffer, for the next flush to try again.
+func (c *DownloadCounter) Flush(d *db.DB) {
+	c.lock.Lock()
+	counts := c.counts
+	c.counts = make(map[downloadKey]int64)
+	c.lock.Unlock()
+
+	if len(counts) == 0 {
+		return
+	}
+	log.Debugf("flushing %d download count(s)", len(counts))
+
+	failed := make(map[downloadKey]int64)
+	for k, n := range counts {
+		if err := addDownloads(d, k, n); err != nil {
+			log.Errorf("unable to record %d download(s) of version '%s' of %s '%s': %s", n, k.version, k.kind, k.name, err)
+			failed[k] = n
+		}
+	}
+
+	if len(failed) > 0 {
+		c.lock.Lock()
+		for k, n := range failed {
+			c.counts[k] += n
+		}
+		c.lock.Unlock()
+	}
+}
+
+// Run flushes the buffered download counts every interval, forever.
+func (c *DownloadCounter) Run(d *db.DB, interval time.Duration) {
+	for range time.Tick(interval) {
+		c.Flush(d)
+	}
+}
+
+func addDownloads(d *db.DB, k downloadKey, n int64) error {
+	return upsert(d, `
+UPDATE downloads
+   SET count   = count + $1
+
+ WHERE kind    = $2
+   AND name    = $3
+   AND version = $4
+   AND day     = $5
+   AND agent   = $6`, []interface{}{n, k.kind, k.name, k.version, k.day, k.agent},
+		`INSERT INTO downloads (kind, name, version, day, agent, count) VALUES ($1, $2, $3, $4, $5, $6)`,
+		k.kind, k.name, k.version, k.day, k.agent, n)
+}
+
+var agentFamilies = []struct {
+	prefix string
+	family string
+}{
+	{"genesis", "genesis"},
+	{"bosh", "bosh"},
+	{"curl", "curl"},
+	{"wget", "wget"},
+	{"go-http-client", "go"},
+	{"python", "python"},
+	{"mozilla", "browser"},
+}
+
+// agentFamily boils a User-Agent header down to the family of client
+// that sent it (curl, bosh, a browser, etc.), so that the counts stay
+// small, and don't keep track of anything too specific.
+func agentFamily(ua string) string {
+	if ua == "" {
+		return "unknown"
+	}
+	ua = strings.ToLower(ua)
+	for _, f := range agentFamilies {
+		if strings.HasPrefix(ua, f.prefix) {
+			return f.family
+		}
+	}
+	return "other"
+}
+
+// A DownloadStat is the number of downloads of a single version of a
+// release or stemcell, over one bucket of time (a day, week or month),
+// broken down by user agent family.
+type DownloadStat struct {
+	Kind      string           `json:"kind"`
+	Name      string           `json:"name"`
+	Version   string           `json:"version"`
+	Period    string           `json:"period"`
+	Downloads int64            `json:"downloads"`
+	Agents    map[string]int64 `json:"agents"`
+}
+
+type DownloadQuery struct {
+	Kind    string
+	Name    string
+	Version string
+	Since   time.Time
+	Until   time.Time
+	Bucket  string
+}
+
+// period works out which bucket of time a day falls into: the day itself,
+// the Monday that starts its week, or its month.
+func period(day, bucket string) string {
+	switch bucket {
+	case "week":
+		t, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			return day
+		}
+		offset := (int(t.Weekday()) + 6) % 7
+		return t.AddDate(0, 0, -offset).Format("2006-01-02")
+	case "month":
+		return day[:7]
+	}
+	return day
+}
+
+func FindDownloadStats(d *db.DB, q DownloadQuery) ([]DownloadStat, error) {
+	l := make([]DownloadStat, 0)
+
+	where := []string{"1 = 1"}
+	args := make([]interface{}, 0)
+	filter := func(clause string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+	if q.Kind != "" {
+		filter("kind = $%d", q.Kind)
+	}
+	if q.Name != "" {
+		filter("name = $%d", q.Name)
+	}
+	if q.Version != "" {
+		filter("version = $%d", q.Version)
+	}
+	if !q.Since.IsZero() {
+		filter("day >= $%d", q.Since.UTC().Format("2006-01-02"))
+	}
+	if !q.Until.IsZero() {
+		filter("day <= $%d", q.Until.UTC().Format("2006-01-02"))
+	}
+
+	r, err := d.Query(fmt.Sprintf(`
+SELECT kind, name, version, day, agent, count
+  FROM downloads
+ WHERE %s`, strings.Join(where, "\n   AND ")), args...)
+	if err != nil {
+		return l, err
+	}
+	defer r.Close()
+
+	stats := make(map[downloadKey]*DownloadStat)
+	for r.Next() {
+		var k downloadKey
+		var n int64
+		if err = r.Scan(&k.kind, &k.name, &k.version, &k.day, &k.agent, &n); err != nil {
+			return l, err
+		}
+
+		agent := k.agent
+		k.day, k.agent = period(k.day, q.Bucket), ""
+		s, ok := stats[k]
+		if !ok {
+			s = &DownloadStat{
+				Kind:    k.kind,
+				Name:    k.name,
+				Version: k.version,
+				Period:  k.day,
+				Agents:  make(map[string]int64),
+			}
+			stats[k] = s
+		}
+		s.Downloads += n
+		s.Agents[agent] += n
+	}
+
+	for _, s := range stats {
+		l = append(l, *s)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if l[i].Period != l[j].Period {
+			return l[i].Period > l[j].Period
+		}
+		if l[i].Kind != l[j].Kind {
+			return l[i].Kind < l[j].Kind
+		}
+		if l[i].Name != l[j].Name {
+			return l[i].Name < l[j].Name
+		}
+		return l[i].Version < l[j].Version
+	})
+	return l, nil
+}
+
+type StatsAPI struct {
+	db *db.DB
+}
+
+func (api StatsAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Debugf("RECV: %s %s", r.Method, r.URL.Path)
+	switch {
+	case match(r, `GET /v1/stats/downloads`):
+		q := DownloadQuery{
+			Kind:    r.URL.Query().Get("kind"),
+			Name:    r.URL.Query().Get("name"),
+			Version: r.URL.Query().Get("version"),
+			Bucket:  r.URL.Query().Get("bucket"),
+		}
+		if q.Kind != "" && q.Kind != "release" && q.Kind != "stemcell" {
+			respond(w, nil, 400, fmt.Sprintf("invalid kind '%s' (must be 'release' or 'stemcell')", q.Kind))
+			return
+		}
+		if q.Bucket != "" && q.Bucket != "day" && q.Bucket != "week" && q.Bucket != "month" {
+			respond(w, nil, 400, fmt.Sprintf("invalid bucket '%s' (must be 'day', 'week' or 'month')", q.Bucket))
+			return
+		}
+		var err error
+		if q.Since, err = parseDate("since", r.URL.Query().Get("since")); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+		if q.Until, err = parseDate("until", r.URL.Query().Get("until")); err != nil {
+			respond(w, nil, 400, err.Error())
+			return
+		}
+
+		log.Debugf("retrieving download statistics")
+		stats, err := FindDownloadStats(api.db, q)
+		respond(w, err, 200, stats)
+		return
+	}
+
+	w.WriteHeader(404)
+}
@@ -2,20 +2,55 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/jhunt/go-db"
 	"github.com/starkandwayne/goutils/log"
 )
 
 type Stemcell struct {
-	Name    string `json:"name"`
-	Version string `json:"version,omitempty"`
-	SHA1    string `json:"sha1,omitempty"`
-	URL     string `json:"url,omitempty"`
+	Name     string `json:"name"`
+	Version  string `json:"version,omitempty"`
+	SHA1     string `json:"sha1,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	URL      string `json:"url,omitempty"`
+	Disabled bool   `json:"disabled"`
+	Mirror   bool   `json:"mirror"`
+	Origin   string `json:"origin,omitempty"`
+	SignedBy string `json:"signed_by,omitempty"`
+	Yanked   *Yank  `json:"yanked,omitempty"`
+	AliasOf  string `json:"alias_of,omitempty"`
+
+	URLs         []string `json:"urls,omitempty"`
+	SignatureURL string   `json:"signature_url,omitempty"`
+	TrustedKeys  []string `json:"trusted_keys,omitempty"`
+
+	Size         int64      `json:"size,omitempty"`
+	ContentType  string     `json:"content_type,omitempty"`
+	LastModified *time.Time `json:"last_modified,omitempty"`
+	ETag         string     `json:"etag,omitempty"`
+	FirstSeen    *time.Time `json:"first_seen,omitempty"`
+	VerifiedAt   *time.Time `json:"verified_at,omitempty"`
+
+	Signature  *Signature       `json:"signature,omitempty"`
+	Advisories []AdvisoryNotice `json:"advisories,omitempty"`
 }
 
-func CreateStemcell(d *db.DB, name, url string) error {
-	return d.Exec(`INSERT INTO stemcells (name, url) VALUES ($1, $2)`, name, url)
+func CreateStemcell(d *db.DB, name, url string, mirror bool) error {
+	if err := available(d, "stemcell", name); err != nil {
+		return err
+	}
+	if err := checkTemplate("stemcell", url); err != nil {
+		return err
+	}
+
+	err := d.Exec(`INSERT INTO stemcells (name, url, mirror) VALUES ($1, $2, $3)`, name, url, mirror)
+	if err != nil {
+		return err
+	}
+
+	touch(d, "stemcell", name)
+	return nil
 }
 
 func FindAllStemcells(d *db.DB) ([]string, error) {
@@ -39,8 +74,9 @@ func FindAllStemcells(d *db.DB) ([]string, error) {
 
 func FindStemcell(d *db.DB, name string) (Stemcell, error) {
 	var o Stemcell
+	var keys, fallbacks string
 
-	r, err := d.Query(`SELECT name, url FROM stemcells WHERE name = $1`, name)
+	r, err := d.Query(`SELECT name, url, disabled, mirror, origin, sig_url, sig_keys, fallback_urls FROM stemcells WHERE name = $1`, name)
 	if err != nil {
 		return o, err
 	}
@@ -48,9 +84,11 @@ func FindStemcell(d *db.DB, name string) (Stemcell, error) {
 	if !r.Next() {
 		return o, fmt.Errorf("stemcell '%s' not found", name)
 	}
-	if err = r.Scan(&o.Name, &o.URL); err != nil {
+	if err = r.Scan(&o.Name, &o.URL, &o.Disabled, &o.Mirror, &o.Origin, &o.SignatureURL, &keys, &fallbacks); err != nil {
 		return o, err
 	}
+	o.TrustedKeys = trustedKeys(keys)
+	o.URLs = templates(o.URL, fallbacks)
 	if r.Next() {
 		return o, fmt.Errorf("duplicate stemcells found for '%s'", name)
 	}
@@ -61,12 +99,30 @@ func FindStemcell(d *db.DB, name string) (Stemcell, error) {
 func FindAllStemcellVersions(d *db.DB, name string) ([]Stemcell, error) {
 	l := make([]Stemcell, 0)
 
+	advisories, err := loadAdvisories(d, "stemcell", name)
+	if err != nil {
+		return l, err
+	}
+
 	r, err := d.Query(`
 SELECT
   name,
   version,
   sha1,
-  url
+  sha256,
+  url,
+  origin,
+  signer,
+  yanked_at,
+  yank_reason,
+  yank_replacement,
+  urls,
+  size,
+  content_type,
+  last_modified,
+  etag,
+  first_seen,
+  verified_at
 
 FROM stemcell_versions
 
@@ -81,9 +137,20 @@ ORDER BY
 
 	for r.Next() {
 		var o Stemcell
-		if err = r.Scan(&o.Name, &o.Version, &o.SHA1, &o.URL); err != nil {
+		var yankedAt, lastModified, firstSeen, verifiedAt int64
+		var yankReason, yankReplacement, urls string
+		if err = r.Scan(&o.Name, &o.Version, &o.SHA1, &o.SHA256, &o.URL, &o.Origin, &o.SignedBy,
+			&yankedAt, &yankReason, &yankReplacement, &urls,
+			&o.Size, &o.ContentType, &lastModified, &o.ETag, &firstSeen, &verifiedAt); err != nil {
 			return l, err
 		}
+		o.Yanked = yanked(yankedAt, yankReason, yankReplacement)
+		o.URLs = versionURLs(o.URL, urls)
+		o.LastModified = timestamp(lastModified)
+		o.FirstSeen = timestamp(firstSeen)
+		o.VerifiedAt = timestamp(verifiedAt)
+		o.Signature = sign("stemcell", o.Name, o.Version, o.SHA1, o.SHA256, o.URL)
+		o.Advisories = advisories.notices(o.Name, o.Version)
 		l = append(l, o)
 	}
 
@@ -101,12 +168,30 @@ ORDER BY
 func FindLatestStemcellVersions(d *db.DB) ([]Stemcell, error) {
 	l := make([]Stemcell, 0)
 
+	advisories, err := loadAdvisories(d, "stemcell", "")
+	if err != nil {
+		return l, err
+	}
+
 	r, err := d.Query(`
 SELECT
   v.name,
   v.version,
   v.sha1,
-  v.url
+  v.sha256,
+  v.url,
+  v.origin,
+  v.signer,
+  v.yanked_at,
+  v.yank_reason,
+  v.yank_replacement,
+  v.urls,
+  v.size,
+  v.content_type,
+  v.last_modified,
+  v.etag,
+  v.first_seen,
+  v.verified_at
 
 FROM
   stemcell_versions v
@@ -117,6 +202,7 @@ FROM
 
     FROM stemcell_versions
     WHERE valid = 1
+      AND yanked_at = 0
     GROUP BY name
   ) q
 
@@ -130,9 +216,20 @@ FROM
 
 	for r.Next() {
 		var o Stemcell
-		if err = r.Scan(&o.Name, &o.Version, &o.SHA1, &o.URL); err != nil {
+		var yankedAt, lastModified, firstSeen, verifiedAt int64
+		var yankReason, yankReplacement, urls string
+		if err = r.Scan(&o.Name, &o.Version, &o.SHA1, &o.SHA256, &o.URL, &o.Origin, &o.SignedBy,
+			&yankedAt, &yankReason, &yankReplacement, &urls,
+			&o.Size, &o.ContentType, &lastModified, &o.ETag, &firstSeen, &verifiedAt); err != nil {
 			return l, err
 		}
+		o.Yanked = yanked(yankedAt, yankReason, yankReplacement)
+		o.URLs = versionURLs(o.URL, urls)
+		o.LastModified = timestamp(lastModified)
+		o.FirstSeen = timestamp(firstSeen)
+		o.VerifiedAt = timestamp(verifiedAt)
+		o.Signature = sign("stemcell", o.Name, o.Version, o.SHA1, o.SHA256, o.URL)
+		o.Advisories = advisories.notices(o.Name, o.Version)
 		l = append(l, o)
 	}
 
@@ -142,6 +239,11 @@ FROM
 func FindStemcellVersion(d *db.DB, name, version string) (Stemcell, error) {
 	var o Stemcell
 
+	advisories, err := loadAdvisories(d, "stemcell", name)
+	if err != nil {
+		return o, err
+	}
+
 	where := ""
 	args := make([]interface{}, 1)
 	args[0] = name
@@ -149,6 +251,9 @@ func FindStemcellVersion(d *db.DB, name, version string) (Stemcell, error) {
 	if version != "" {
 		where = "AND version = $2"
 		args = append(args, version)
+	} else {
+		/* yanked versions are never the latest */
+		where = "AND yanked_at = 0"
 	}
 
 	r, err := d.Query(fmt.Sprintf(`
@@ -156,7 +261,20 @@ SELECT
   name,
   version,
   sha1,
-  url
+  sha256,
+  url,
+  origin,
+  signer,
+  yanked_at,
+  yank_reason,
+  yank_replacement,
+  urls,
+  size,
+  content_type,
+  last_modified,
+  etag,
+  first_seen,
+  verified_at
 
 FROM
   stemcell_versions
@@ -183,9 +301,20 @@ LIMIT 1
 		}
 		return o, fmt.Errorf("stemcell '%s' not found", name)
 	}
-	if err = r.Scan(&o.Name, &o.Version, &o.SHA1, &o.URL); err != nil {
+	var yankedAt, lastModified, firstSeen, verifiedAt int64
+	var yankReason, yankReplacement, urls string
+	if err = r.Scan(&o.Name, &o.Version, &o.SHA1, &o.SHA256, &o.URL, &o.Origin, &o.SignedBy,
+		&yankedAt, &yankReason, &yankReplacement, &urls,
+		&o.Size, &o.ContentType, &lastModified, &o.ETag, &firstSeen, &verifiedAt); err != nil {
 		return o, err
 	}
+	o.Yanked = yanked(yankedAt, yankReason, yankReplacement)
+	o.URLs = versionURLs(o.URL, urls)
+	o.LastModified = timestamp(lastModified)
+	o.FirstSeen = timestamp(firstSeen)
+	o.VerifiedAt = timestamp(verifiedAt)
+	o.Signature = sign("stemcell", o.Name, o.Version, o.SHA1, o.SHA256, o.URL)
+	o.Advisories = advisories.notices(o.Name, o.Version)
 	if r.Next() {
 		return o, fmt.Errorf("duplicate stemcells found for '%s'", name)
 	}
@@ -194,70 +323,212 @@ LIMIT 1
 }
 
 func DeleteStemcell(d *db.DB, name string) error {
+	digests := mirrored(d, "stemcell", name, "")
 	err := d.Exec(`DELETE FROM stemcell_versions WHERE name = $1`, name)
 	if err != nil {
 		return err
 	}
 
-	return d.Exec(`DELETE FROM stemcells WHERE name = $1`, name)
+	err = d.Exec(`DELETE FROM stemcells WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+
+	err = dropAliases(d, "stemcell", name)
+	if err != nil {
+		return err
+	}
+
+	err = d.Exec(`DELETE FROM checks WHERE kind = $1 AND name = $2`, "stemcell", name)
+	if err != nil {
+		return err
+	}
+
+	err = d.Exec(`DELETE FROM downloads WHERE kind = $1 AND name = $2`, "stemcell", name)
+	if err != nil {
+		return err
+	}
+
+	unmirror(d, digests)
+	touch(d, "stemcell", name)
+	return nil
 }
 
 func DeleteStemcellVersion(d *db.DB, name, version string) error {
-	return d.Exec(`DELETE FROM stemcell_versions WHERE name = $1 AND version = $2`, name, version)
+	digests := mirrored(d, "stemcell", name, version)
+	err := d.Exec(`DELETE FROM stemcell_versions WHERE name = $1 AND version = $2`, name, version)
+	if err != nil {
+		return err
+	}
+
+	unmirror(d, digests)
+	touch(d, "stemcell", name)
+	return nil
 }
 
-func CheckStemcellVersion(d *db.DB, name, version string) error {
+func CheckStemcellVersion(d *db.DB, name, version string, c VersionCheck) error {
 	stemcell, err := FindStemcell(d, name)
 	if err != nil {
 		log.Debugf("unable to find stemcell '%s': %s", name, err)
 		return err
 	}
 
-	/* generate the URL from the template */
-	url := urlify(stemcell.URL, version)
-	log.Debugf("checking version '%s' of '%s' at '%s'", version, name, url)
+	n, err := d.Count(`SELECT * FROM stemcell_versions WHERE name = $1 AND version = $2`, name, version)
+	if err != nil {
+		return err
+	}
+	recheck := n > 0
 
-	recheck := true
-	n, _ := d.Count(`SELECT * FROM stemcell_versions WHERE name = $1 AND version = $2`, name, version)
-	if n == 0 {
+	if c.Trusted && c.resumed && recheck {
+		/* picking up where a trusted registration left off before a
+		   restart, so it was this check that registered the version */
 		recheck = false
+
+	} else if c.Trusted {
+		/* take the caller's word for it, for now... */
+		if err = trustable(d, "stemcell", name); err != nil {
+			return err
+		}
+		if recheck {
+			return fmt.Errorf("version '%s' of stemcell '%s' is already known, so it cannot be registered before it is checked", version, name)
+		}
+		url := c.URL
+		if url == "" {
+			url = urlify("stemcell", name, stemcell.URL, version)
+		}
+		log.Debugf("registering version '%s' of '%s' at '%s' (sha1 %s) before checking it", version, name, url, c.SHA1)
+		if err = register(d, "stemcell", name, version, c.SHA1, c.SHA256, url); err != nil {
+			return err
+		}
+		/* ...but still check it against the real thing */
+	}
+
+	if c.URL != "" {
+		log.Debugf("checking version '%s' of '%s' at '%s'", version, name, c.URL)
+	} else {
+		log.Debugf("checking version '%s' of '%s' at %v", version, name, stemcell.URLs)
+	}
+
+	if !recheck && !c.Trusted {
 		num, err := vnum(version)
 		if err != nil {
 			return err
 		}
-		err = d.Exec(`INSERT INTO stemcell_versions (name, version, vnum, valid) VALUES ($1, $2, $3, 0)`,
-			name, version, num)
+		err = d.Exec(`INSERT INTO stemcell_versions (name, version, vnum, valid, first_seen) VALUES ($1, $2, $3, 0, $4)`,
+			name, version, num, time.Now().Unix())
 		if err != nil {
 			log.Debugf("unable to check version '%s' of '%s': %s", version, name, err)
 			return err
 		}
 	}
+	checkpoint(d, "stemcell", name, version, c)
 
 	/* do the async part in its own goroutine */
-	go func() {
-		/* download and SHA1 the file */
-		sha1, err := sha1sum(url)
-		if err != nil {
-			log.Debugf("download/sha1sum failed: %s...", err)
-			if !recheck {
-				d.Exec(`DELETE FROM stemcell_versions WHERE name = $1 AND version = $2`,
-					name, version)
-			}
-			return
-		}
+	c.ticket = enqueue("stemcell", name, version, c)
+	go verifyStemcellVersion(d, stemcell, version, c, recheck)
 
-		err = d.Exec(`
+	return nil
+}
+
+// verifyStemcellVersion downloads, checksums (and mirrors, and verifies
+// the upstream signature of) a version of a stemcell, and marks it valid.
+// If that fails, versions that weren't already known are forgotten.
+func verifyStemcellVersion(d *db.DB, stemcell Stemcell, version string, c VersionCheck, recheck bool) {
+	defer finish(c.ticket)
+	name := stemcell.Name
+
+	/* download and checksum the file (mirroring it if need be),
+	   from the given URL, or each of the URL templates in turn */
+	sigurl := ""
+	if stemcell.SignatureURL != "" {
+		sigurl = urlify("stemcell", name, stemcell.SignatureURL, version)
+	}
+	var urls []string
+	var dl download
+	var err error
+	if c.URL != "" {
+		urls = []string{c.URL}
+		dl, err = checksum(c.URL, stemcell.Mirror, sigurl, stemcell.TrustedKeys)
+	} else {
+		urls, dl, err = checksumAll("stemcell", name, stemcell.URLs, version, stemcell.Mirror, sigurl, stemcell.TrustedKeys)
+	}
+	mismatch := false
+	if err == nil {
+		if err = c.expect(dl.sha1, dl.sha256); err != nil {
+			unmirror(d, []string{dl.sha256})
+			mismatch = true
+		}
+	}
+	if err != nil {
+		log.Debugf("download/sha1sum/verification failed: %s...", err)
+		setCheckStatus(d, c.RequestID, "stemcell", name, version, "failed", err.Error())
+		/* versions this check added are dropped if they fail it,
+		   except for trusted ones, which only go if they turn out
+		   not to match (not if upstream is just unreachable) */
+		if !recheck && (!c.Trusted || mismatch) {
+			d.Exec(`DELETE FROM stemcell_versions WHERE name = $1 AND version = $2`,
+				name, version)
+			touch(d, "stemcell", name)
+		}
+		return
+	}
+	err = d.Exec(`
 	UPDATE stemcell_versions
-	SET valid     = 1,
-		url       = $3,
-		sha1      = $4
+	SET valid         = 1,
+		url           = $1,
+		sha1          = $2,
+		sha256        = $3,
+		signer        = $4,
+		urls          = $5,
+		size          = $6,
+		content_type  = $7,
+		last_modified = $8,
+		etag          = $9,
+		verified_at   = $10
+
+	WHERE name    = $11
+	  AND version = $12`, urls[0], dl.sha1, dl.sha256, dl.signer, jsonList(urls),
+		dl.size, dl.contentType, dl.lastModified, dl.etag, time.Now().Unix(), name, version)
 
-	WHERE name    = $1
-	  AND version = $2`, name, version, url, sha1)
+	if err != nil {
+		log.Debugf("unable to check version '%s' of '%s': %s", version, name, err)
+		setCheckStatus(d, c.RequestID, "stemcell", name, version, "failed", err.Error())
+		return
+	}
+	setCheckStatus(d, c.RequestID, "stemcell", name, version, "ok", "")
 
-		if err != nil {
-			log.Debugf("unable to check version '%s' of '%s': %s", version, name, err)
-			return
+	touch(d, "stemcell", name)
+}
+
+// RecheckStemcellVersions re-verifies every known version of a stemcell, one
+// at a time and in the background, against its current URL template
+// (and signature settings).  Versions that fail are left as they were.
+func RecheckStemcellVersions(d *db.DB, name, rid string) error {
+	stemcell, err := FindStemcell(d, name)
+	if err != nil {
+		return err
+	}
+	versions, err := FindAllStemcellVersions(d, name)
+	if err != nil {
+		return err
+	}
+
+	checks := make([]VersionCheck, len(versions))
+	for i, v := range versions {
+		checks[i] = VersionCheck{RequestID: rid}
+		checks[i].ticket = enqueue("stemcell", name, v.Version, checks[i])
+	}
+
+	go func() {
+		for i, v := range versions {
+			if draining() {
+				for j := i; j < len(versions); j++ {
+					shelve(d, "stemcell", name, versions[j].Version, checks[j])
+				}
+				return
+			}
+			log.Debugf("re-checking version '%s' of '%s'", v.Version, name)
+			verifyStemcellVersion(d, stemcell, v.Version, checks[i], true)
 		}
 	}()
 
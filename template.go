@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/jhunt/go-db"
+)
+
+// URL templates are plain text, with `{{ ... }}` blocks that name a
+// variable, optionally piped through one or more filters:
+//
+//     https://github.com/org/{{name}}/releases/download/v{{version}}/{{name}}-{{version}}.tgz
+//     https://example.com/{{major}}.x/{{name | replace "-" "_"}}_{{version | trimprefix "v"}}.tgz
+//
+// The variables are name, version, major, minor, patch and prerelease
+// (all of which are taken from the version being checked), plus os and
+// iaas for stemcells (which are taken from the stemcell name).
+
+var templateVariables = map[string][]string{
+	"release":  {"name", "version", "major", "minor", "patch", "prerelease"},
+	"stemcell": {"name", "version", "major", "minor", "patch", "prerelease", "os", "iaas"},
+}
+
+var templateFilters = map[string]struct {
+	args int
+	fn   func(string, []string) string
+}{
+	"trimprefix": {1, func(s string, a []string) string { return strings.TrimPrefix(s, a[0]) }},
+	"replace":    {2, func(s string, a []string) string { return strings.Replace(s, a[0], a[1], -1) }},
+	"lower":      {0, func(s string, a []string) string { return strings.ToLower(s) }},
+}
+
+type urlTemplate []templatePart
+
+// A templatePart is either literal text, or a variable (with filters).
+type templatePart struct {
+	text     string
+	variable string
+	filters  []templateFilter
+}
+
+type templateFilter struct {
+	name string
+	args []string
+}
+
+// parseTemplate parses (and validates) a URL template for a release
+// or stemcell.
+func parseTemplate(kind, s string) (urlTemplate, error) {
+	var t urlTemplate
+	rest := s
+	for rest != "" {
+		i := strings.Index(rest, "{{")
+		if i < 0 {
+			t = append(t, templatePart{text: rest})
+			break
+		}
+		if i > 0 {
+			t = append(t, templatePart{text: rest[:i]})
+		}
+		rest = rest[i+2:]
+
+		j := strings.Index(rest, "}}")
+		if j < 0 {
+			return nil, fmt.Errorf("invalid template '%s': unterminated {{", s)
+		}
+		part, err := parseExpression(kind, rest[:j])
+		if err != nil {
+			return nil, fmt.Errorf("invalid template '%s': %s", s, err)
+		}
+		t = append(t, part)
+		rest = rest[j+2:]
+	}
+	return t, nil
+}
+
+// parseExpression parses the inside of a `{{ ... }}` block.
+func parseExpression(kind, s string) (templatePart, error) {
+	var part templatePart
+
+	words, err := tokenize(s)
+	if err != nil {
+		return part, err
+	}
+
+	/* split the words up into pipeline stages */
+	var stages [][]string
+	stage := []string{}
+	for _, w := range words {
+		if w == "|" {
+			stages = append(stages, stage)
+			stage = []string{}
+			continue
+		}
+		stage = append(stage, w)
+	}
+	stages = append(stages, stage)
+
+	if len(stages[0]) != 1 {
+		return part, fmt.Errorf("expected a single variable in {{%s}}", s)
+	}
+	part.variable = stages[0][0]
+	known := false
+	for _, v := range templateVariables[kind] {
+		known = known || v == part.variable
+	}
+	if !known {
+		return part, fmt.Errorf("unknown variable '%s' (%ss can use %s)",
+			part.variable, kind, strings.Join(templateVariables[kind], ", "))
+	}
+
+	for _, stage := range stages[1:] {
+		if len(stage) == 0 {
+			return part, fmt.Errorf("missing filter in {{%s}}", s)
+		}
+		f, ok := templateFilters[stage[0]]
+		if !ok {
+			return part, fmt.Errorf("unknown filter '%s'", stage[0])
+		}
+		if len(stage)-1 != f.args {
+			return part, fmt.Errorf("filter '%s' takes %d argument(s), not %d", stage[0], f.args, len(stage)-1)
+		}
+		part.filters = append(part.filters, templateFilter{name: stage[0], args: stage[1:]})
+	}
+	return part, nil
+}
+
+// tokenize splits an expression into bare words, double-quoted strings
+// (which may contain spaces and pipes) and pipes.
+func tokenize(s string) ([]string, error) {
+	var l []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case unicode.IsSpace(rune(c)):
+			i++
+
+		case c == '|':
+			l = append(l, "|")
+			i++
+
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string in {{%s}}", s)
+			}
+			word, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s in {{%s}}", s[i:j+1], s)
+			}
+			l = append(l, word)
+			i = j + 1
+
+		default:
+			j := i
+			for ; j < len(s) && s[j] != '|' && s[j] != '"' && !unicode.IsSpace(rune(s[j])); j++ {
+			}
+			l = append(l, s[i:j])
+			i = j
+		}
+	}
+	return l, nil
+}
+
+func (t urlTemplate) render(vars map[string]string) string {
+	var b strings.Builder
+	for _, part := range t {
+		if part.variable == "" {
+			b.WriteString(part.text)
+			continue
+		}
+		v := vars[part.variable]
+		for _, f := range part.filters {
+			v = templateFilters[f.name].fn(v, f.args)
+		}
+		b.WriteString(v)
+	}
+	return b.String()
+}
+
+// checkTemplate validates a URL template, for error reporting.
+func checkTemplate(kind, s string) error {
+	_, err := parseTemplate(kind, s)
+	return err
+}
+
+var semver = regexp.MustCompile(`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:[-.+](.+))?$`)
+
+var stemcellOS = regexp.MustCompile(`^(ubuntu|centos|rhel|windows|photon|opensuse|sles)`)
+
+// templateVars works out the values of all of the template variables
+// for a given version of a release or stemcell.
+func templateVars(kind, name, version string) map[string]string {
+	vars := make(map[string]string)
+	for _, v := range templateVariables[kind] {
+		vars[v] = ""
+	}
+	vars["name"] = name
+	vars["version"] = version
+
+	if m := semver.FindStringSubmatch(version); m != nil {
+		vars["major"], vars["minor"], vars["patch"], vars["prerelease"] = m[1], m[2], m[3], m[4]
+		if vars["minor"] == "" {
+			vars["minor"] = "0"
+		}
+		if vars["patch"] == "" {
+			vars["patch"] = "0"
+		}
+	}
+
+	/* stemcell names look like bosh-aws-xen-hvm-ubuntu-trusty-go_agent,
+	   i.e. bosh-IAAS-(HYPERVISOR...)-OS-go_agent */
+	if kind == "stemcell" {
+		words := strings.Split(strings.TrimPrefix(strings.TrimPrefix(name, "light-"), "bosh-"), "-")
+		vars["iaas"] = words[0]
+		for i, w := range words[1:] {
+			if stemcellOS.MatchString(w) {
+				os := words[i+1:]
+				for j, w := range os {
+					if w == "go_agent" {
+						os = os[:j]
+						break
+					}
+				}
+				vars["os"] = strings.Join(os, "-")
+				break
+			}
+		}
+	}
+	return vars
+}
+
+// urlify renders a URL template for a given version of a release or
+// stemcell.  Templates that predate the current template language (and
+// don't parse) only ever get {{version}} filled in.
+func urlify(kind, name, template, version string) string {
+	t, err := parseTemplate(kind, template)
+	if err != nil {
+		return strings.Replace(template, "{{version}}", version, -1)
+	}
+	return t.render(templateVars(kind, name, version))
+}
+
+// A Preview shows what the URL templates of a release or stemcell turn
+// into for a given version, without downloading anything.
+type Preview struct {
+	Version      string            `json:"version"`
+	Variables    map[string]string `json:"variables"`
+	URLs         []string          `json:"urls"`
+	SignatureURL string            `json:"signature_url,omitempty"`
+}
+
+// PreviewTemplates renders the given templates (or, if there aren't
+// any, those of the named release or stemcell) for a version.
+func PreviewTemplates(d *db.DB, kind, name, version string, l []string) (Preview, error) {
+	p := Preview{
+		Version:   version,
+		Variables: templateVars(kind, name, version),
+		URLs:      make([]string, 0),
+	}
+
+	sigurl := ""
+	if len(l) == 0 {
+		r, err := d.Query(fmt.Sprintf(`SELECT url, fallback_urls, sig_url FROM %ss WHERE name = $1`, kind), name)
+		if err != nil {
+			return p, err
+		}
+		if !r.Next() {
+			r.Close()
+			return p, fmt.Errorf("%s '%s' not found", kind, name)
+		}
+		var url, fallbacks string
+		err = r.Scan(&url, &fallbacks, &sigurl)
+		r.Close()
+		if err != nil {
+			return p, err
+		}
+		l = templates(url, fallbacks)
+	}
+
+	for _, t := range l {
+		p.URLs = append(p.URLs, urlify(kind, name, t, version))
+	}
+	if sigurl != "" {
+		p.SignatureURL = urlify(kind, name, sigurl, version)
+	}
+	return p, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-db"
+	"github.com/starkandwayne/goutils/log"
+)
+
+// Releases and stemcells can have more than one URL template; the
+// first one lives in the `url` column (as it always has), and the
+// rest, in order, are kept as a JSON list in `fallback_urls`.  When a
+// version is checked, each template is tried in turn, and every URL
+// that serves up the right bits is recorded (in order) on the version,
+// so that downloads can fail over from one to the next.
+
+// templates returns the full, ordered list of URL templates, given the
+// url and fallback_urls columns.
+func templates(url, fallbacks string) []string {
+	l := []string{url}
+	var more []string
+	json.Unmarshal([]byte(fallbacks), &more)
+	return append(l, more...)
+}
+
+// versionURLs returns the list of URLs that a version was found at,
+// given its url and urls columns.  Versions that came in from another
+// index (or an import) only have the one.
+func versionURLs(url, urls string) []string {
+	var l []string
+	json.Unmarshal([]byte(urls), &l)
+	if len(l) == 0 && url != "" {
+		l = []string{url}
+	}
+	return l
+}
+
+// jsonList encodes a list of URLs (or URL templates) for storage.
+func jsonList(l []string) string {
+	if len(l) == 0 {
+		return "[]"
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		return "[]"
+	}
+	return string(b)
+}
+
+// checkTemplates validates an ordered list of URL templates, splitting
+// it into the primary template, and the JSON list of fallbacks.
+func checkTemplates(kind string, l []string) (string, string, error) {
+	if len(l) == 0 {
+		return "", "", fmt.Errorf("at least one url is required")
+	}
+	for _, t := range l {
+		if t == "" {
+			return "", "", fmt.Errorf("url cannot be empty")
+		}
+		if err := checkTemplate(kind, t); err != nil {
+			return "", "", err
+		}
+	}
+	return l[0], jsonList(l[1:]), nil
+}
+
+// setTemplates replaces the URL templates of a release or stemcell.
+func setTemplates(d *db.DB, kind, name string, l []string) error {
+	url, fallbacks, err := checkTemplates(kind, l)
+	if err != nil {
+		return err
+	}
+
+	n, err := d.Count(fmt.Sprintf(`SELECT * FROM %ss WHERE name = $1`, kind), name)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s '%s' not found", kind, name)
+	}
+
+	err = d.Exec(fmt.Sprintf(`UPDATE %ss SET url = $1, fallback_urls = $2 WHERE name = $3`, kind),
+		url, fallbacks, name)
+	if err != nil {
+		return err
+	}
+
+	touch(d, kind, name)
+	return nil
+}
+
+// checksumAll downloads a version from the first of its URL templates
+// that works, and checksums (and mirrors, and verifies, as need be)
+// that.  The rest are downloaded, checksummed and verified as well, and
+// recorded only if they serve up exactly the same bits, since downloads
+// can be sent to any of them.  What upstream had to say about the
+// download (its size, Content-Type, etc.) comes from the first URL.
+func checksumAll(kind, name string, l []string, version string, mirror bool, sigurl string, keys []string) ([]string, download, error) {
+	var urls []string
+	var dl download
+	err := fmt.Errorf("no url templates to check")
+
+	for _, t := range l {
+		url := urlify(kind, name, t, version)
+		if len(urls) == 0 {
+			dl, err = checksum(url, mirror, sigurl, keys)
+			if err != nil {
+				log.Debugf("download/sha1sum/verification of '%s' failed: %s...", url, err)
+				continue
+			}
+			urls = append(urls, url)
+			continue
+		}
+
+		fb, ferr := checksum(url, false, sigurl, keys)
+		if ferr != nil {
+			log.Debugf("download/sha1sum/verification of fallback '%s' failed: %s...", url, ferr)
+			continue
+		}
+		if fb.sha1 != dl.sha1 || fb.sha256 != dl.sha256 {
+			log.Errorf("fallback '%s' does not match '%s' (sha1 %s, not %s); ignoring it", url, urls[0], fb.sha1, dl.sha1)
+			continue
+		}
+		urls = append(urls, url)
+	}
+
+	if len(urls) == 0 {
+		return nil, dl, err
+	}
+	return urls, dl, nil
+}
+
+var prober = &http.Client{Timeout: 5 * time.Second}
+
+// head checks (with a HEAD request) that a URL can still be downloaded
+// from, and returns the size of what it would download, or -1 if
+// upstream didn't say.
+func head(url string) (int64, error) {
+	r, err := prober.Head(url)
+	if err != nil {
+		return -1, err
+	}
+	r.Body.Close()
+	if r.StatusCode >= 400 {
+		return -1, fmt.Errorf("HEAD %s returned %s", url, r.Status)
+	}
+	return r.ContentLength, nil
+}
+
+type urlHealth struct {
+	ok      bool
+	at      time.Time
+	probing bool
+}
+
+var health = struct {
+	sync.Mutex
+	checked map[string]urlHealth
+}{checked: make(map[string]urlHealth)}
+
+// healthTTL is how long the health of an upstream URL is remembered
+// for, before it is probed again.  URLs that nobody has asked about
+// in twice that long are forgotten altogether.
+const healthTTL = 5 * time.Minute
+
+// healthy says whether a URL could still be downloaded from, the last
+// time it was probed.  It never waits on a probe, since there is a
+// download waiting on the answer: URLs that haven't been probed lately
+// are probed in the background, and until then, get the benefit of the
+// doubt.
+func healthy(url string) bool {
+	health.Lock()
+	defer health.Unlock()
+
+	h, ok := health.checked[url]
+	if !ok {
+		h.ok = true
+	}
+	if !h.probing && time.Since(h.at) >= healthTTL {
+		h.probing = true
+		go probe(url)
+	}
+	health.checked[url] = h
+	return h.ok
+}
+
+// probe checks the health of a URL, and records it for healthy().
+func probe(url string) {
+	h := urlHealth{at: time.Now()}
+	if _, err := head(url); err != nil {
+		log.Debugf("health check of '%s' failed: %s", url, err)
+	} else {
+		h.ok = true
+	}
+
+	health.Lock()
+	defer health.Unlock()
+	health.checked[url] = h
+	for u, old := range health.checked {
+		if !old.probing && time.Since(old.at) > 2*healthTTL {
+			delete(health.checked, u)
+		}
+	}
+}
+
+// pick chooses the first healthy URL to send a download to.  If none
+// of them look healthy, the first one is as good as any.  Every one of
+// them was checked (in full) against the version, by checksumAll.
+func pick(urls []string) string {
+	if len(urls) == 0 {
+		return ""
+	}
+	if len(urls) > 1 {
+		for _, url := range urls {
+			if healthy(url) {
+				return url
+			}
+		}
+	}
+	return urls[0]
+}
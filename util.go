@@ -2,38 +2,148 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/jhunt/go-db"
 	"github.com/starkandwayne/goutils/log"
 )
 
-func urlify(template string, version string) string {
-	re := regexp.MustCompile("{{version}}")
-	return re.ReplaceAllLiteralString(template, version)
+// A download is what fetch found out about a URL: the checksums and
+// size of what it got back, and what upstream had to say about it.
+type download struct {
+	sha1         string
+	sha256       string
+	signer       string
+	size         int64
+	contentType  string
+	lastModified int64
+	etag         string
 }
 
-func sha1sum(url string) (string, error) {
+type counter int64
+
+func (n *counter) Write(b []byte) (int, error) {
+	*n += counter(len(b))
+	return len(b), nil
+}
+
+// fetch downloads url and returns the SHA1 and SHA256 checksums of
+// what it got back.  If keep is not nil, the downloaded bytes are
+// also written to it as they are read.
+func fetch(url string, keep io.Writer) (download, error) {
+	var dl download
+	var n counter
+	start := time.Now()
+	defer func() { downloadBytes.Add(float64(n)) }()
+
 	r, err := http.Get(url)
 	if err != nil {
-		return "", err
+		downloadDuration.Since(start, "failed")
+		return dl, err
 	}
+	defer r.Body.Close()
 
-	h := sha1.New()
-	io.Copy(h, r.Body)
-	return fmt.Sprintf("%x", h.Sum(nil)), nil
+	if r.StatusCode != 200 {
+		downloadDuration.Since(start, "failed")
+		return dl, fmt.Errorf("GET %s returned %s", url, r.Status)
+	}
+
+	body := io.TeeReader(r.Body, &n)
+	if keep != nil {
+		body = io.TeeReader(body, keep)
+	}
+	if dl.sha1, dl.sha256, err = checksums(body); err != nil {
+		downloadDuration.Since(start, "failed")
+		return dl, err
+	}
+	downloadDuration.Since(start, "ok")
+
+	dl.size = int64(n)
+	dl.contentType = r.Header.Get("Content-Type")
+	dl.etag = r.Header.Get("ETag")
+	if t, err := http.ParseTime(r.Header.Get("Last-Modified")); err == nil {
+		dl.lastModified = t.Unix()
+	}
+	return dl, nil
+}
+
+// checksums reads r to the end, and returns the SHA1 and SHA256
+// checksums of everything it read.
+func checksums(r io.Reader) (string, string, error) {
+	h1 := sha1.New()
+	h256 := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(h1, h256), r); err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%x", h1.Sum(nil)), fmt.Sprintf("%x", h256.Sum(nil)), nil
+}
+
+// checksum downloads url and computes its checksums.  If mirror is
+// set (and a blobstore has been configured) the verified bytes are
+// kept in the blobstore as well.  If sigurl is set, the download
+// must verify against the detached signature found there, using one
+// of the trusted keys; the ID of the signing key is recorded.
+func checksum(url string, mirror bool, sigurl string, keys []string) (download, error) {
+	mirror = mirror && blobs != nil
+	if !mirror && sigurl == "" {
+		return fetch(url, nil)
+	}
+
+	tmp, err := ioutil.TempFile("", "genesis-index")
+	if err != nil {
+		return download{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	dl, err := fetch(url, tmp)
+	if err != nil {
+		return dl, err
+	}
+
+	if sigurl != "" {
+		if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+			return dl, err
+		}
+		if dl.signer, err = verifyUpstream(sigurl, keys, tmp); err != nil {
+			return dl, err
+		}
+	}
+
+	if mirror {
+		size, err := tmp.Seek(0, io.SeekEnd)
+		if err == nil {
+			if _, err = tmp.Seek(0, io.SeekStart); err == nil {
+				err = blobs.Put(dl.sha256, tmp, size)
+			}
+		}
+		if err != nil {
+			/* we can always fall back to redirecting upstream */
+			log.Errorf("unable to mirror %s: %s", url, err)
+		}
+	}
+	return dl, nil
 }
 
 func match(req *http.Request, pattern string) bool {
 	matched, _ := regexp.MatchString(
 		fmt.Sprintf("^%s$", pattern),
 		fmt.Sprintf("%s %s", req.Method, req.URL.Path))
+	if matched {
+		routed(req, pattern)
+	}
 	return matched
 }
 
@@ -45,7 +155,9 @@ func extract(r *http.Request, pattern string) string {
 func bail(w http.ResponseWriter, e error) {
 	w.WriteHeader(500)
 
-	fmt.Printf("responding with an error: [%s]\n", e)
+	if !failed(w, e) {
+		log.Errorf("responding with an error: %s", e)
+	}
 	x := struct {
 		E string `json:"e"`
 	}{E: e.Error()}
@@ -57,6 +169,12 @@ func bail(w http.ResponseWriter, e error) {
 	}
 }
 
+// warn adds an (RFC 7234) Warning header to a response, for clients to
+// pass along to their users.
+func warn(w http.ResponseWriter, msg string) {
+	w.Header().Add("Warning", fmt.Sprintf(`299 genesis-index %s`, strconv.Quote(msg)))
+}
+
 func respond(w http.ResponseWriter, e error, status int, payload interface{}) {
 	w.Header().Set("Content-type", "application/json")
 
@@ -67,7 +185,6 @@ func respond(w http.ResponseWriter, e error, status int, payload interface{}) {
 
 	if payload != nil {
 		if s, ok := payload.(string); ok {
-			fmt.Printf("SEND %d %s\n", status, s)
 			payload = struct {
 				M string `json:"m"`
 			}{M: s}
@@ -101,6 +218,7 @@ func authed(w http.ResponseWriter, r *http.Request) bool {
 	}
 
 	if try_user == auth_user && try_pass == auth_pass {
+		info(r).principal = try_user
 		return true
 	}
 
@@ -140,3 +258,196 @@ func vnum(v string) (uint64, error) {
 
 	return n, nil
 }
+
+// timestamp converts a Unix time from the database into a time.Time,
+// or nil if it was never set.
+func timestamp(t int64) *time.Time {
+	if t == 0 {
+		return nil
+	}
+	u := time.Unix(t, 0).UTC()
+	return &u
+}
+
+// parseDate parses a date-ish query parameter (like `since`), which can
+// either be a date (2006-01-02) or a full RFC 3339 timestamp.  An empty
+// value means no filtering at all, and comes back as the zero time.
+func parseDate(param, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s '%s' (expected YYYY-MM-DD, or an RFC 3339 timestamp)", param, s)
+}
+
+// seenSince filters a list of release or stemcell versions down to
+// those first seen at (or after) t.  Versions that predate first-seen
+// tracking are left out.  Lists that come out of the cache are shared,
+// so they are copied rather than modified.
+func seenSince(v interface{}, t time.Time) interface{} {
+	if t.IsZero() {
+		return v
+	}
+
+	switch o := v.(type) {
+	case []Release:
+		l := make([]Release, 0)
+		for _, x := range o {
+			if x.FirstSeen != nil && !x.FirstSeen.Before(t) {
+				l = append(l, x)
+			}
+		}
+		return l
+	case []Stemcell:
+		l := make([]Stemcell, 0)
+		for _, x := range o {
+			if x.FirstSeen != nil && !x.FirstSeen.Before(t) {
+				l = append(l, x)
+			}
+		}
+		return l
+	}
+	return v
+}
+
+// go-db doesn't do transactions, or say how many rows a statement
+// changed, so the odd write that needs either goes through a plain
+// database/sql handle on the same database, opened (once) on demand.
+var pools = struct {
+	sync.Mutex
+	open map[string]*sql.DB
+}{open: make(map[string]*sql.DB)}
+
+func pool(d *db.DB) (*sql.DB, error) {
+	pools.Lock()
+	defer pools.Unlock()
+
+	key := d.Driver + "\x00" + d.DSN
+	if p, ok := pools.open[key]; ok {
+		return p, nil
+	}
+	p, err := sql.Open(d.Driver, d.DSN)
+	if err != nil {
+		return nil, err
+	}
+	pools.open[key] = p
+	return p, nil
+}
+
+// closePools closes the database/sql handles opened by pool().
+func closePools() error {
+	pools.Lock()
+	defer pools.Unlock()
+
+	var failed error
+	for key, p := range pools.open {
+		if err := p.Close(); err != nil {
+			failed = err
+		}
+		delete(pools.open, key)
+	}
+	return failed
+}
+
+// transaction runs fn inside of a database transaction, committing it if
+// fn succeeds, and rolling it back if not.
+func transaction(d *db.DB, fn func(tx *sql.Tx) error) error {
+	p, err := pool(d)
+	if err != nil {
+		return err
+	}
+
+	tx, err := p.Begin()
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// affected runs a statement, like go-db's Exec, but also returns how many
+// rows it affected.
+func affected(d *db.DB, query string, args ...interface{}) (int64, error) {
+	p, err := pool(d)
+	if err != nil {
+		return 0, err
+	}
+	res, err := p.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// upsert runs update and, if that didn't change anything (because the
+// row isn't there yet), insert.  If the insert fails because something
+// else (i.e. another instance) inserted the same row first, the update
+// is tried again.  This is for counters and the like, which can't use
+// INSERT ... ON CONFLICT, since the SQLite we link against predates it.
+func upsert(d *db.DB, update string, uargs []interface{}, insert string, iargs ...interface{}) error {
+	n, err := affected(d, update, uargs...)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	err = d.Exec(insert, iargs...)
+	if err == nil {
+		return nil
+	}
+	if n, again := affected(d, update, uargs...); again == nil && n > 0 {
+		return nil
+	}
+	return err
+}
+
+// register records a known-good version of a release or stemcell
+// directly, without downloading and checking it against upstream.
+func register(d *db.DB, kind, name, version, sha1, sha256, url string) error {
+	num, err := vnum(version)
+	if err != nil {
+		return err
+	}
+
+	n, err := d.Count(fmt.Sprintf(`SELECT * FROM %s_versions WHERE name = $1 AND version = $2`, kind),
+		name, version)
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		err = d.Exec(fmt.Sprintf(`
+	INSERT INTO %s_versions
+	  (name, version, vnum, sha1, sha256, url, valid, first_seen)
+	VALUES ($1, $2, $3, $4, $5, $6, 1, $7)`, kind), name, version, num, sha1, sha256, url, time.Now().Unix())
+	} else {
+		err = d.Exec(fmt.Sprintf(`
+	UPDATE %s_versions
+	SET valid         = 1,
+		url           = $1,
+		sha1          = $2,
+		sha256        = $3,
+		urls          = '[]',
+		size          = 0,
+		content_type  = '',
+		last_modified = 0,
+		etag          = '',
+		verified_at   = 0
+
+	WHERE name    = $4
+	  AND version = $5`, kind), url, sha1, sha256, name, version)
+	}
+	if err != nil {
+		return err
+	}
+
+	touch(d, kind, name)
+	return nil
+}
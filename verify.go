@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jhunt/go-db"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Some upstreams publish a detached signature alongside each tarball,
+// either a minisign signature or an OpenPGP (GPG) one.  Artifacts can
+// be configured with a URL template for those signatures, and a set of
+// trusted public keys; when they are, a version is only ever marked
+// valid if its tarball verifies against one of those keys.
+//
+// Minisign signatures are checked here, in-process.  GPG signatures
+// are handed off to the gpg binary, which must be on the $PATH.
+
+const maxSignatureSize = 1024 * 1024
+
+// keyType works out what kind of public key k is: "gpg" for an ASCII
+// armored OpenPGP public key block, or "minisign" for a minisign key
+// (either the bare base64 line, or the whole .pub file).
+func keyType(k string) (string, error) {
+	if strings.Contains(k, "-----BEGIN PGP PUBLIC KEY BLOCK-----") {
+		return "gpg", nil
+	}
+	if _, _, err := parseMinisignKey(k); err != nil {
+		return "", fmt.Errorf("trusted key is neither an armored GPG public key nor a minisign public key")
+	}
+	return "minisign", nil
+}
+
+func parseMinisignKey(k string) (string, ed25519.PublicKey, error) {
+	line := ""
+	for _, l := range strings.Split(k, "\n") {
+		if l = strings.TrimSpace(l); l != "" && !strings.HasPrefix(l, "untrusted comment:") {
+			line = l
+		}
+	}
+
+	b, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(b) != 2+8+ed25519.PublicKeySize || string(b[0:2]) != "Ed" {
+		return "", nil, fmt.Errorf("not a minisign public key")
+	}
+	return minisignKeyID(b[2:10]), ed25519.PublicKey(b[10:]), nil
+}
+
+// minisignKeyID formats a key ID the way that minisign itself does,
+// as a little-endian 64-bit number, in upper-case hex.
+func minisignKeyID(b []byte) string {
+	var s string
+	for i := len(b) - 1; i >= 0; i-- {
+		s += fmt.Sprintf("%02X", b[i])
+	}
+	return s
+}
+
+// checkVerification validates a signature URL template and set of
+// trusted keys, before they are stored.
+func checkVerification(kind, sigurl string, keys []string) error {
+	if sigurl != "" && len(keys) == 0 {
+		return fmt.Errorf("a signature URL needs at least one trusted key to check against")
+	}
+	if sigurl != "" {
+		if err := checkTemplate(kind, sigurl); err != nil {
+			return err
+		}
+	}
+	for _, k := range keys {
+		if _, err := keyType(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setVerification configures (or, with an empty sigurl, removes)
+// upstream signature verification for a release or stemcell.
+func setVerification(d *db.DB, kind, name, sigurl string, keys []string) error {
+	if err := checkVerification(kind, sigurl, keys); err != nil {
+		return err
+	}
+	n, err := d.Count(fmt.Sprintf(`SELECT * FROM %ss WHERE name = $1`, kind), name)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s '%s' not found", kind, name)
+	}
+
+	if keys == nil {
+		keys = []string{}
+	}
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	err = d.Exec(fmt.Sprintf(`UPDATE %ss SET sig_url = $1, sig_keys = $2 WHERE name = $3`, kind),
+		sigurl, string(b), name)
+	if err != nil {
+		return err
+	}
+
+	touch(d, kind, name)
+	return nil
+}
+
+// trustedKeys decodes the sig_keys column.
+func trustedKeys(s string) []string {
+	var keys []string
+	if s != "" {
+		json.Unmarshal([]byte(s), &keys)
+	}
+	return keys
+}
+
+// verifyUpstream downloads the detached signature at sigurl, and
+// checks data against it using the trusted keys.  It returns the ID
+// of the key that made the signature.
+func verifyUpstream(sigurl string, keys []string, data io.Reader) (string, error) {
+	if len(keys) == 0 {
+		return "", fmt.Errorf("no trusted keys to check %s against", sigurl)
+	}
+
+	r, err := http.Get(sigurl)
+	if err != nil {
+		return "", err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != 200 {
+		return "", fmt.Errorf("GET %s returned %s", sigurl, r.Status)
+	}
+	sig, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSignatureSize))
+	if err != nil {
+		return "", err
+	}
+
+	if bytes.HasPrefix(sig, []byte("untrusted comment:")) {
+		return verifyMinisign(sig, keys, data)
+	}
+	return verifyGPG(sig, keys, data)
+}
+
+func verifyMinisign(sig []byte, keys []string, data io.Reader) (string, error) {
+	var lines []string
+	s := bufio.NewScanner(bytes.NewReader(sig))
+	for s.Scan() {
+		lines = append(lines, strings.TrimRight(s.Text(), "\r"))
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return "", fmt.Errorf("malformed minisign signature")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(b) != 2+8+ed25519.SignatureSize {
+		return "", fmt.Errorf("malformed minisign signature")
+	}
+	alg, id, signature := string(b[0:2]), minisignKeyID(b[2:10]), b[10:]
+
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return "", fmt.Errorf("malformed minisign signature")
+	}
+
+	var pub ed25519.PublicKey
+	for _, k := range keys {
+		if kid, key, err := parseMinisignKey(k); err == nil && kid == id {
+			pub = key
+			break
+		}
+	}
+	if pub == nil {
+		return "", fmt.Errorf("minisign signature was made by key %s, which is not trusted", id)
+	}
+
+	var msg []byte
+	switch alg {
+	case "ED": /* prehashed */
+		h, err := blake2b.New512(nil)
+		if err != nil {
+			return "", err
+		}
+		if _, err = io.Copy(h, data); err != nil {
+			return "", err
+		}
+		msg = h.Sum(nil)
+	case "Ed": /* legacy; signs the whole file */
+		if msg, err = ioutil.ReadAll(data); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported minisign signature algorithm '%s'", alg)
+	}
+
+	if !ed25519.Verify(pub, msg, signature) {
+		return "", fmt.Errorf("minisign signature verification failed")
+	}
+	trusted := append(append([]byte{}, signature...), []byte(strings.TrimPrefix(lines[2], "trusted comment: "))...)
+	if !ed25519.Verify(pub, trusted, global) {
+		return "", fmt.Errorf("minisign signature verification failed (bad trusted comment)")
+	}
+	return "minisign:" + id, nil
+}
+
+func verifyGPG(sig []byte, keys []string, data io.Reader) (string, error) {
+	home, err := ioutil.TempDir("", "genesis-index-gpg")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(home)
+
+	gpg := func(in io.Reader, args ...string) ([]byte, error) {
+		cmd := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--no-tty", "--status-fd", "1"}, args...)...)
+		cmd.Stdin = in
+		return cmd.Output()
+	}
+
+	n := 0
+	for _, k := range keys {
+		if t, _ := keyType(k); t != "gpg" {
+			continue
+		}
+		if _, err = gpg(strings.NewReader(k), "--import"); err != nil {
+			return "", fmt.Errorf("unable to import trusted GPG key: %s", err)
+		}
+		n++
+	}
+	if n == 0 {
+		return "", fmt.Errorf("signature is not a minisign signature, and there are no trusted GPG keys")
+	}
+
+	file := filepath.Join(home, "tarball.sig")
+	if err = ioutil.WriteFile(file, sig, 0600); err != nil {
+		return "", err
+	}
+
+	/* gpg exits non-zero for bad signatures, but we insist on seeing
+	   both GOODSIG (which excludes expired and revoked keys) and
+	   VALIDSIG, for the full fingerprint */
+	out, err := gpg(data, "--verify", file, "-")
+	good, fpr := false, ""
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.Fields(l)
+		if len(f) < 3 || f[0] != "[GNUPG:]" {
+			continue
+		}
+		switch f[1] {
+		case "GOODSIG":
+			good = true
+		case "VALIDSIG":
+			fpr = f[2]
+		}
+	}
+	if err != nil || !good || fpr == "" {
+		return "", fmt.Errorf("GPG signature verification failed")
+	}
+	return "gpg:" + fpr, nil
+}
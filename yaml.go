@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// We don't vendor a YAML library, and only ever need YAML for the
+// export / import document format, so what follows is a small codec
+// for the block-style subset of YAML that covers plain old data:
+// mappings, sequences, and scalars.  Everything is converted to and
+// from Go values via encoding/json, so the `json:"..."` struct tags
+// apply to YAML documents as well.
+//
+// Plain (unquoted) scalars are only numbers or booleans if that's what
+// they are being decoded into, so that `version: 1.2` is the string
+// "1.2" (and not 1.2, or worse, `3421.10` the number 3421.1), and a
+// release can be named `yes`.
+
+func toYAML(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err = d.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString("---\n")
+	yamlNode(&out, generic, 0)
+	return out.Bytes(), nil
+}
+
+func fromYAML(src []byte, v interface{}) error {
+	var lines []string
+	for _, l := range strings.Split(string(src), "\n") {
+		l = strings.TrimRight(l, " \t\r")
+		t := strings.TrimSpace(l)
+		if t == "" || t == "---" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		if lead := l[:len(l)-len(strings.TrimLeft(l, " \t"))]; strings.Contains(lead, "\t") {
+			return fmt.Errorf("tabs are not allowed for YAML indentation")
+		}
+		lines = append(lines, l)
+	}
+
+	var generic interface{}
+	if len(lines) > 0 {
+		p := &yamlParser{lines: lines}
+		var err error
+		generic, err = p.node(indentOf(lines[0]))
+		if err != nil {
+			return err
+		}
+		if p.i < len(lines) {
+			return fmt.Errorf("unexpected YAML content at '%s'", strings.TrimSpace(lines[p.i]))
+		}
+		generic = typed(generic, reflect.TypeOf(v))
+	}
+
+	b, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func yamlScalar(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case nil:
+		return "~", true
+	case bool:
+		return fmt.Sprintf("%t", x), true
+	case json.Number:
+		return x.String(), true
+	case string:
+		b, _ := json.Marshal(x)
+		return string(b), true
+	case map[string]interface{}:
+		if len(x) == 0 {
+			return "{}", true
+		}
+	case []interface{}:
+		if len(x) == 0 {
+			return "[]", true
+		}
+	}
+	return "", false
+}
+
+func yamlNode(out *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if s, ok := yamlScalar(x[k]); ok {
+				fmt.Fprintf(out, "%s%s: %s\n", pad, k, s)
+				continue
+			}
+			fmt.Fprintf(out, "%s%s:\n", pad, k)
+			yamlNode(out, x[k], indent+2)
+		}
+
+	case []interface{}:
+		for _, item := range x {
+			if s, ok := yamlScalar(item); ok {
+				fmt.Fprintf(out, "%s- %s\n", pad, s)
+				continue
+			}
+
+			/* render the item two spaces in, and then tuck the
+			   sequence indicator into the indentation of its
+			   first line. */
+			var sub bytes.Buffer
+			yamlNode(&sub, item, indent+2)
+			out.WriteString(pad + "- ")
+			out.Write(sub.Bytes()[indent+2:])
+		}
+
+	default:
+		s, _ := yamlScalar(x)
+		fmt.Fprintf(out, "%s%s\n", pad, s)
+	}
+}
+
+type yamlParser struct {
+	lines []string
+	i     int
+}
+
+func indentOf(l string) int {
+	return len(l) - len(strings.TrimLeft(l, " "))
+}
+
+func isSeqItem(t string) bool {
+	return t == "-" || strings.HasPrefix(t, "- ")
+}
+
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	if isSeqItem(strings.TrimSpace(p.lines[p.i])) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitKey(strings.TrimSpace(p.lines[p.i])); ok {
+		return p.mapping(indent)
+	}
+
+	v, err := parseScalar(strings.TrimSpace(p.lines[p.i]))
+	p.i++
+	return v, err
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+
+	for p.i < len(p.lines) && indentOf(p.lines[p.i]) == indent {
+		t := strings.TrimSpace(p.lines[p.i])
+		if isSeqItem(t) {
+			break
+		}
+		k, rest, ok := splitKey(t)
+		if !ok {
+			return nil, fmt.Errorf("expected a 'key: value' pair at '%s'", t)
+		}
+		p.i++
+
+		if rest != "" {
+			v, err := parseScalar(rest)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = v
+			continue
+		}
+
+		/* nested block: either indented further, or a sequence
+		   at the same level as its key */
+		if p.i < len(p.lines) {
+			next := p.lines[p.i]
+			if n := indentOf(next); n > indent || (n == indent && isSeqItem(strings.TrimSpace(next))) {
+				v, err := p.node(n)
+				if err != nil {
+					return nil, err
+				}
+				m[k] = v
+				continue
+			}
+		}
+		m[k] = nil
+	}
+
+	if p.i < len(p.lines) && indentOf(p.lines[p.i]) > indent {
+		return nil, fmt.Errorf("bad YAML indentation at '%s'", strings.TrimSpace(p.lines[p.i]))
+	}
+	return m, nil
+}
+
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	l := make([]interface{}, 0)
+
+	for p.i < len(p.lines) && indentOf(p.lines[p.i]) == indent {
+		t := strings.TrimSpace(p.lines[p.i])
+		if !isSeqItem(t) {
+			break
+		}
+		rest := strings.TrimSpace(strings.TrimPrefix(t, "-"))
+
+		if rest == "" {
+			p.i++
+			if p.i < len(p.lines) && indentOf(p.lines[p.i]) > indent {
+				v, err := p.node(indentOf(p.lines[p.i]))
+				if err != nil {
+					return nil, err
+				}
+				l = append(l, v)
+			} else {
+				l = append(l, nil)
+			}
+			continue
+		}
+
+		/* replace the sequence indicator with whitespace, so that
+		   the item can be parsed like any other block */
+		inner := indent + len(t) - len(rest)
+		p.lines[p.i] = strings.Repeat(" ", inner) + rest
+		v, err := p.node(inner)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+
+	return l, nil
+}
+
+// splitKey splits a "key: value" line, handling quoted keys.  ok is
+// false if the line isn't a mapping entry at all.
+func splitKey(t string) (string, string, bool) {
+	if strings.HasPrefix(t, `"`) || strings.HasPrefix(t, `'`) {
+		end := strings.Index(t[1:], t[0:1])
+		if end < 0 {
+			return "", "", false
+		}
+		k, err := parseScalar(t[:end+2])
+		rest := t[end+2:]
+		if err != nil || !(rest == ":" || strings.HasPrefix(rest, ": ")) {
+			return "", "", false
+		}
+		return fmt.Sprintf("%v", k), strings.TrimSpace(rest[1:]), true
+	}
+
+	if i := strings.Index(t, ": "); i > 0 {
+		return t[:i], strings.TrimSpace(t[i+2:]), true
+	}
+	if strings.HasSuffix(t, ":") && len(t) > 1 {
+		return t[:len(t)-1], "", true
+	}
+	return "", "", false
+}
+
+// A yamlPlain is a plain (unquoted) scalar, which typed() turns into a
+// string, number, boolean or null, depending on where it's headed.
+type yamlPlain string
+
+func parseScalar(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+
+	case strings.HasPrefix(s, `'`):
+		if len(s) < 2 || !strings.HasSuffix(s, `'`) {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.Replace(s[1:len(s)-1], `''`, `'`, -1), nil
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+
+	switch s {
+	case "[]":
+		return []interface{}{}, nil
+	case "{}":
+		return map[string]interface{}{}, nil
+	}
+	return yamlPlain(s), nil
+}
+
+var jsonUnmarshaler = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// typed resolves the plain scalars in a parsed YAML document, according
+// to the Go type t that it is going to be decoded into (nil if unknown).
+func typed(v interface{}, t reflect.Type) interface{} {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = typed(e, fieldType(t, k))
+		}
+	case []interface{}:
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for i := range x {
+			x[i] = typed(x[i], elem)
+		}
+	case yamlPlain:
+		return plain(string(x), t)
+	}
+	return v
+}
+
+// fieldType returns the type of whatever a mapping key is decoded into,
+// matching struct fields the way encoding/json does.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		var fold reflect.Type
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" || (f.PkgPath != "" && !f.Anonymous) {
+				continue
+			}
+			if f.Anonymous && name == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					if inner := fieldType(ft, key); inner != nil {
+						return inner
+					}
+					continue
+				}
+			}
+			if name == "" {
+				name = f.Name
+			}
+			if name == key {
+				return f.Type
+			}
+			if fold == nil && strings.EqualFold(name, key) {
+				fold = f.Type
+			}
+		}
+		return fold
+	}
+	return nil
+}
+
+func plain(s string, t reflect.Type) interface{} {
+	null := s == "~" || s == "null" || s == "Null" || s == "NULL"
+	if t == nil || t.Kind() == reflect.Interface {
+		/* no idea what it should be; make an educated guess */
+		switch {
+		case null:
+			return nil
+		case s == "true" || s == "True" || s == "TRUE":
+			return true
+		case s == "false" || s == "False" || s == "FALSE":
+			return false
+		}
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+		return s
+	}
+	if reflect.PtrTo(t).Implements(jsonUnmarshaler) {
+		/* i.e. time.Time, which wants a string */
+		return s
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		switch s {
+		case "true", "True", "TRUE", "yes", "Yes":
+			return true
+		case "false", "False", "FALSE", "no", "No":
+			return false
+		}
+		if null {
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if null {
+			return nil
+		}
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return json.Number(s)
+		}
+	case reflect.String:
+		return s
+	default:
+		if null {
+			return nil
+		}
+	}
+	/* let encoding/json complain about it */
+	return s
+}
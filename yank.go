@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jhunt/go-db"
+)
+
+// A Yank records why a version was pulled, and what to use instead.
+// Yanked versions are never considered for "latest", but can still be
+// looked up (and downloaded) by exact version, so that anyone pinned
+// to them doesn't break.
+type Yank struct {
+	Reason      string    `json:"reason"`
+	Replacement string    `json:"replacement,omitempty"`
+	At          time.Time `json:"at"`
+}
+
+// yanked builds the Yank for a version from its yanked_at,
+// yank_reason and yank_replacement columns, or nil if the version has
+// not been yanked.
+func yanked(at int64, reason, replacement string) *Yank {
+	if at == 0 {
+		return nil
+	}
+	return &Yank{
+		Reason:      reason,
+		Replacement: replacement,
+		At:          time.Unix(at, 0).UTC(),
+	}
+}
+
+// sameYank says whether two versions have been yanked the same way (or
+// both not at all).
+func sameYank(a, b *Yank) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Reason == b.Reason && a.Replacement == b.Replacement && a.At.Equal(b.At)
+}
+
+// warnYanked adds a Warning header to the response for a pinned
+// version lookup, if that version has been yanked.
+func warnYanked(w http.ResponseWriter, kind, name, version string, y *Yank) {
+	if y == nil {
+		return
+	}
+	msg := fmt.Sprintf("%s %s v%s has been yanked: %s", kind, name, version, y.Reason)
+	if y.Replacement != "" {
+		msg = fmt.Sprintf("%s (use v%s instead)", msg, y.Replacement)
+	}
+	warn(w, msg)
+}
+
+func YankVersion(d *db.DB, kind, name, version, reason, replacement string) error {
+	if reason == "" {
+		return fmt.Errorf("a reason is required to yank a version")
+	}
+
+	n, err := d.Count(fmt.Sprintf(`SELECT * FROM %s_versions WHERE name = $1 AND version = $2 AND valid = 1`, kind),
+		name, version)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("version '%s' of %s '%s' not found", version, kind, name)
+	}
+
+	if replacement != "" {
+		if replacement == version {
+			return fmt.Errorf("a version cannot be its own replacement")
+		}
+		n, err = d.Count(fmt.Sprintf(`SELECT * FROM %s_versions WHERE name = $1 AND version = $2 AND valid = 1 AND yanked_at = 0`, kind),
+			name, replacement)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("replacement version '%s' of %s '%s' not found (or also yanked)", replacement, kind, name)
+		}
+	}
+
+	err = d.Exec(fmt.Sprintf(`
+	UPDATE %s_versions
+	SET yanked_at        = $1,
+		yank_reason      = $2,
+		yank_replacement = $3
+
+	WHERE name    = $4
+	  AND version = $5`, kind), time.Now().Unix(), reason, replacement, name, version)
+	if err != nil {
+		return err
+	}
+
+	touch(d, kind, name)
+	return nil
+}
+
+// setYank records the yank state of a version exactly as given (or, for
+// a nil Yank, clears it), for versions brought in by an import or from
+// an upstream index.  Unlike YankVersion, it doesn't insist that the
+// replacement exists, since it may not have been brought in yet.
+func setYank(d *db.DB, kind, name, version string, y *Yank) error {
+	var at int64
+	var reason, replacement string
+	if y != nil {
+		at, reason, replacement = y.At.Unix(), y.Reason, y.Replacement
+		if at <= 0 {
+			at = time.Now().Unix()
+		}
+	}
+
+	err := d.Exec(fmt.Sprintf(`
+	UPDATE %s_versions
+	SET yanked_at        = $1,
+		yank_reason      = $2,
+		yank_replacement = $3
+
+	WHERE name    = $4
+	  AND version = $5`, kind), at, reason, replacement, name, version)
+	if err != nil {
+		return err
+	}
+
+	touch(d, kind, name)
+	return nil
+}
+
+func UnyankVersion(d *db.DB, kind, name, version string) error {
+	n, err := d.Count(fmt.Sprintf(`SELECT * FROM %s_versions WHERE name = $1 AND version = $2 AND yanked_at <> 0`, kind),
+		name, version)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("version '%s' of %s '%s' has not been yanked", version, kind, name)
+	}
+
+	err = d.Exec(fmt.Sprintf(`
+	UPDATE %s_versions
+	SET yanked_at        = 0,
+		yank_reason      = '',
+		yank_replacement = ''
+
+	WHERE name    = $1
+	  AND version = $2`, kind), name, version)
+	if err != nil {
+		return err
+	}
+
+	touch(d, kind, name)
+	return nil
+}